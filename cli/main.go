@@ -2,13 +2,17 @@ package main
 
 import (
 	"bufio"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/argon-chat/k3sd/cluster"
 	"github.com/argon-chat/k3sd/utils"
 	"log"
 	"os"
 	"os/exec"
+	"os/signal"
 	"strings"
+	"syscall"
 )
 
 func main() {
@@ -18,10 +22,65 @@ func main() {
 		fmt.Printf("K3SD version: %s\n", utils.Version)
 		os.Exit(0)
 	}
+	if utils.ConfigPath == "" {
+		os.Exit(2)
+	}
+	if utils.Command == utils.CommandValidate {
+		os.Exit(validate())
+	}
+	if utils.Command == utils.CommandBundle {
+		if err := bundle(); err != nil {
+			log.Fatal(err)
+		}
+		os.Exit(0)
+	}
 
-	clusters, err := cluster.LoadClusters(utils.ConfigPath)
+	unlock, err := cluster.LockClusters(utils.ConfigPath)
+	if err != nil {
+		log.Fatalf("failed to lock clusters: %v", err)
+	}
+	releaseOnSignal(unlock)
+	err = run()
+	if unlockErr := unlock(); unlockErr != nil {
+		log.Printf("failed to release lock: %v", unlockErr)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// releaseOnSignal releases the config lock and exits when the process is interrupted or terminated,
+// so that the next run is not refused because of a lock file left behind.
+//
+// Parameters:
+//   - unlock: The function releasing the lock, as returned by cluster.LockClusters.
+func releaseOnSignal(unlock func() error) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		if err := unlock(); err != nil {
+			log.Printf("failed to release lock: %v", err)
+		}
+		log.Fatalf("interrupted by %v", sig)
+	}()
+}
+
+func run() error {
+	clusters, errs, err := cluster.CheckClusters(utils.ConfigPath)
 	if err != nil {
-		log.Fatalf("failed to load clusters: %v", err)
+		return fmt.Errorf("failed to load clusters: %v", err)
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid cluster config:\n%v", errs)
+	}
+	if err := cluster.ResolveSecrets(utils.ConfigPath, clusters); err != nil {
+		return fmt.Errorf("failed to resolve secrets:\n%v", err)
+	}
+	if utils.RenderDir != "" {
+		if err := cluster.RenderManifests(utils.RenderDir, clusters); err != nil {
+			return fmt.Errorf("failed to render manifests: %v", err)
+		}
 	}
 
 	logger := utils.NewLogger("cli")
@@ -30,46 +89,138 @@ func main() {
 	go logger.LogWorkerFile()
 	go logger.LogWorkerCmd()
 
-	checkCommandExists()
+	if err := checkCommandExists(); err != nil {
+		return err
+	}
+
+	save := func(clusters []cluster.Cluster) error {
+		return cluster.SaveClusters(utils.ConfigPath, clusters)
+	}
 
-	if utils.Uninstall {
+	if utils.Command == utils.CommandUpgrade {
+		if utils.UpgradeTo == "" {
+			return errors.New("must specify --to")
+		}
+		clusters, err = cluster.UpgradeCluster(clusters, utils.UpgradeTo, logger, save)
+		if err != nil {
+			return fmt.Errorf("failed to upgrade clusters: %v", err)
+		}
+	} else if utils.Uninstall {
 		reader := bufio.NewReader(os.Stdin)
 		fmt.Print("Are you sure you want to uninstall the clusters? (yes/no): ")
 		response, _ := reader.ReadString('\n')
 		response = strings.TrimSpace(strings.ToLower(response))
 
 		if response == "yes" {
-			clusters, err = cluster.UninstallCluster(clusters, logger)
+			clusters, err = cluster.UninstallCluster(clusters, logger, save)
 			if err != nil {
-				log.Fatalf("failed to uninstall clusters: %v", err)
+				return fmt.Errorf("failed to uninstall clusters: %v", err)
 			}
 		} else {
 			fmt.Println("Uninstallation canceled.")
-			return
+			return nil
 		}
 	} else {
-		clusters, err = cluster.CreateCluster(clusters, logger, []string{})
+		clusters, err = cluster.CreateCluster(clusters, logger, []string{}, save)
 		if err != nil {
-			log.Fatalf("failed to create clusters: %v", err)
+			return fmt.Errorf("failed to create clusters: %v", err)
 		}
 	}
 
-	if err := cluster.SaveClusters(utils.ConfigPath, clusters); err != nil {
-		log.Fatalf("failed to save clusters: %v", err)
+	if err := save(clusters); err != nil {
+		return fmt.Errorf("failed to save clusters: %v", err)
+	}
+	return nil
+}
+
+// validationReport is the machine-readable result of the validate command.
+type validationReport struct {
+	File   string                `json:"file"`
+	Valid  bool                  `json:"valid"`
+	Errors []cluster.ConfigError `json:"errors"`
+}
+
+// validate loads the config and checks it without connecting to any host, printing every problem found.
+//
+// Returns:
+//   - int: The exit code: 0 if the config is valid, 1 if it is not, 2 on an unknown output format.
+func validate() int {
+	report := validationReport{File: utils.ConfigPath, Errors: []cluster.ConfigError{}}
+	clusters, errs, err := cluster.CheckClusters(utils.ConfigPath)
+	if err != nil {
+		report.Errors = append(report.Errors, cluster.ConfigError{File: utils.ConfigPath, Message: err.Error()})
+	}
+	report.Errors = append(report.Errors, errs...)
+	report.Valid = len(report.Errors) == 0
+	if report.Valid && utils.RenderDir != "" {
+		if err := cluster.RenderManifests(utils.RenderDir, clusters); err != nil {
+			log.Printf("failed to render manifests: %v", err)
+			return 1
+		}
+	}
+
+	switch utils.Output {
+	case "json":
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(report); err != nil {
+			log.Printf("failed to write report: %v", err)
+			return 1
+		}
+	case "text":
+		for _, configErr := range report.Errors {
+			fmt.Println(configErr.Error())
+		}
+		if report.Valid {
+			fmt.Printf("%s: OK\n", utils.ConfigPath)
+		}
+	default:
+		log.Printf("unknown output format %q, want text or json", utils.Output)
+		return 2
+	}
+
+	if !report.Valid {
+		return 1
+	}
+	return 0
+}
+
+// bundle downloads the air-gap bundle for the clusters in the config into the --airgap-bundle directory.
+//
+// Returns:
+//   - error: An error if the config cannot be loaded or a download fails.
+func bundle() error {
+	if utils.AirgapBundle == "" {
+		return errors.New("must specify --airgap-bundle")
+	}
+	clusters, err := cluster.LoadClusters(utils.ConfigPath)
+	if err != nil {
+		return fmt.Errorf("failed to load clusters: %v", err)
+	}
+
+	logger := utils.NewLogger("cli")
+	go logger.LogWorker()
+	go logger.LogWorkerErr()
+	go logger.LogWorkerFile()
+	go logger.LogWorkerCmd()
+
+	if err := cluster.BuildAirgapBundle(utils.AirgapBundle, utils.K3sVersion, utils.Arch, clusters, logger); err != nil {
+		return fmt.Errorf("failed to build airgap bundle: %v", err)
 	}
+	return nil
 }
 
-func checkCommandExists() {
+func checkCommandExists() error {
 	commands := []string{
 		"linkerd",
 		"kubectl",
 		"step",
-		"ssh",
 	}
 
 	for _, cmd := range commands {
 		if _, err := exec.LookPath(cmd); err != nil {
-			log.Fatalf("Command %s not found. Please install it.", cmd)
+			return fmt.Errorf("Command %s not found. Please install it.", cmd)
 		}
 	}
+	return nil
 }
@@ -0,0 +1,199 @@
+package cluster
+
+import (
+	"fmt"
+	"github.com/argon-chat/k3sd/utils"
+	"strings"
+	"sync"
+)
+
+// Addon is an optional application installed on a cluster once K3s is running.
+// Addons register themselves with RegisterAddon and are enabled per cluster by the
+// cluster's addons block or, for the built-in ones, by the CLI flags.
+type Addon interface {
+	// Name returns the key that enables the addon in a cluster's addons block. It is also
+	// the name of the addon's provisioning step, accepted by --force-step.
+	Name() string
+	// Dependencies returns the names of the addons that must be installed first.
+	// Enabling an addon enables its dependencies.
+	Dependencies() []string
+	// Validate checks the cluster config the addon needs, without connecting to any host.
+	Validate(cluster Cluster) error
+	// Install installs the addon.
+	Install(env AddonEnv) error
+	// Uninstall removes the addon.
+	Uninstall(env AddonEnv) error
+	// Status reports whether the addon is installed.
+	Status(env AddonEnv) (bool, error)
+}
+
+// AddonEnv is the cluster an addon operates on.
+//
+// Fields:
+//   - Cluster: The cluster, including its addons block.
+//   - Master: The Executor for the cluster's master node, where kubectl and helm have cluster access.
+//   - Kubeconfig: The path of the cluster's kubeconfig on this machine.
+//   - Logger: A pointer to a utils.Logger instance for logging operations.
+type AddonEnv struct {
+	Cluster    Cluster       // The cluster, including its addons block.
+	Master     Executor      // Executor for the cluster's master node.
+	Kubeconfig string        // Path of the cluster's kubeconfig on this machine.
+	Logger     *utils.Logger // Logger for the addon's output.
+}
+
+var (
+	// addonsMu guards the addon registry.
+	addonsMu sync.RWMutex
+	// addonRegistry holds every registered addon, keyed by name.
+	addonRegistry = map[string]Addon{}
+	// addonOrder lists the registered addon names in registration order, which breaks ties when ordering installs.
+	addonOrder []string
+)
+
+// RegisterAddon makes an addon available to every cluster. It panics if an addon with
+// the same name is already registered, and is meant to be called from init functions.
+//
+// Parameters:
+//   - addon: The addon to register.
+func RegisterAddon(addon Addon) {
+	addonsMu.Lock()
+	defer addonsMu.Unlock()
+	name := addon.Name()
+	if _, ok := addonRegistry[name]; ok {
+		panic(fmt.Sprintf("addon %s is already registered", name))
+	}
+	addonRegistry[name] = addon
+	addonOrder = append(addonOrder, name)
+}
+
+// LookupAddon returns the registered addon with the given name.
+//
+// Parameters:
+//   - name: The name of the addon.
+//
+// Returns:
+//   - Addon: The addon, or nil if none is registered under that name.
+//   - bool: True if the addon is registered.
+func LookupAddon(name string) (Addon, bool) {
+	addonsMu.RLock()
+	defer addonsMu.RUnlock()
+	addon, ok := addonRegistry[name]
+	return addon, ok
+}
+
+// RegisteredAddons returns every registered addon in registration order.
+//
+// Returns:
+//   - []Addon: The registered addons.
+func RegisteredAddons() []Addon {
+	addonsMu.RLock()
+	defer addonsMu.RUnlock()
+	addons := make([]Addon, len(addonOrder))
+	for i, name := range addonOrder {
+		addons[i] = addonRegistry[name]
+	}
+	return addons
+}
+
+// clusterAddons returns the registered and declared addons enabled on a cluster together with their dependencies,
+// ordered so that every addon comes after the addons it depends on. A dependency the addons block disables is
+// an error rather than being switched back on.
+//
+// Parameters:
+//   - cluster: The cluster whose addons are resolved.
+//
+// Returns:
+//   - []Addon: The addons to install, in order.
+//   - error: An error if an addon or dependency is not registered or is disabled, or the dependencies form a cycle.
+func clusterAddons(cluster Cluster) ([]Addon, error) {
+	for name := range cluster.Addons {
+		if _, ok := cluster.lookupAddon(name); !ok {
+			return nil, fmt.Errorf("unknown addon %s", name)
+		}
+	}
+
+	const (
+		visiting = 1
+		visited  = 2
+	)
+	state := map[string]int{}
+	var ordered []Addon
+	var visit func(name string, path []string) error
+	visit = func(name string, path []string) error {
+		switch state[name] {
+		case visited:
+			return nil
+		case visiting:
+			return fmt.Errorf("addon dependency cycle: %s", strings.Join(append(path, name), " -> "))
+		}
+		addon, ok := cluster.lookupAddon(name)
+		if !ok {
+			return fmt.Errorf("addon %s depends on unknown addon %s", path[len(path)-1], name)
+		}
+		if enabled := cluster.Addons[name].Enabled; len(path) > 0 && enabled != nil && !*enabled {
+			return fmt.Errorf("addon %s depends on %s, which the addons block disables", path[len(path)-1], name)
+		}
+		state[name] = visiting
+		for _, dependency := range addon.Dependencies() {
+			if err := visit(dependency, append(path, name)); err != nil {
+				return err
+			}
+		}
+		state[name] = visited
+		ordered = append(ordered, addon)
+		return nil
+	}
+
+	var names []string
+	for _, addon := range RegisteredAddons() {
+		names = append(names, addon.Name())
+	}
+	for _, extra := range cluster.ExtraAddons {
+		names = append(names, extra.Name)
+	}
+	for _, name := range names {
+		if !cluster.addonEnabled(name) {
+			continue
+		}
+		if err := visit(name, nil); err != nil {
+			return nil, err
+		}
+	}
+	return ordered, nil
+}
+
+// lookupAddon returns the addon with the given name, declared in the cluster's extraAddons
+// or registered with RegisterAddon.
+//
+// Parameters:
+//   - name: The name of the addon.
+//
+// Returns:
+//   - Addon: The addon, or nil if there is none with that name.
+//   - bool: True if the addon exists.
+func (c Cluster) lookupAddon(name string) (Addon, bool) {
+	for _, extra := range c.ExtraAddons {
+		if extra.Name == name {
+			return declaredAddon{extra}, true
+		}
+	}
+	return LookupAddon(name)
+}
+
+// addonSteps returns a provisioning step installing each addon.
+//
+// Parameters:
+//   - addons: The addons to install, in order.
+//   - env: The cluster the addons are installed on.
+//
+// Returns:
+//   - []step: One step per addon, named after it.
+func addonSteps(addons []Addon, env AddonEnv) []step {
+	steps := make([]step, len(addons))
+	for i, addon := range addons {
+		steps[i] = step{name: addon.Name(), run: func() error {
+			return addon.Install(env)
+		}}
+	}
+	return steps
+}
@@ -0,0 +1,315 @@
+package cluster
+
+import (
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+func init() {
+	RegisterAddon(shellAddon{
+		name:      AddonPrometheus,
+		manifests: []string{"prom-stack-values.yaml"},
+		validate: func(cluster Cluster) error {
+			return requireBundleFiles(bundleHelm, prometheusChart(cluster.addonVersion(AddonPrometheus, defaultPrometheusVersion)))
+		},
+		install: func(cluster Cluster) []string {
+			version := cluster.addonVersion(AddonPrometheus, defaultPrometheusVersion)
+			if airgapped() {
+				return []string{fmt.Sprintf("KUBECONFIG=/etc/rancher/k3s/k3s.yaml helm upgrade --install kube-prom-stack %s --namespace monitoring --create-namespace -f /tmp/yamls/prom-stack-values.yaml", airgapPath(prometheusChart(version)))}
+			}
+			return []string{
+				"curl -fsSL https://raw.githubusercontent.com/helm/helm/main/scripts/get-helm-3 | bash",
+				"helm version",
+				"helm repo add prometheus-community https://prometheus-community.github.io/helm-charts",
+				"helm repo update prometheus-community",
+				fmt.Sprintf("KUBECONFIG=/etc/rancher/k3s/k3s.yaml helm upgrade --install kube-prom-stack prometheus-community/kube-prometheus-stack --version \"%s\" --namespace monitoring --create-namespace -f /tmp/yamls/prom-stack-values.yaml", version),
+			}
+		},
+		images: func(cluster Cluster, bundle string) ([]string, error) {
+			return chartImages(bundle, prometheusChart(cluster.addonVersion(AddonPrometheus, defaultPrometheusVersion)))
+		},
+		uninstall: func(cluster Cluster) []string {
+			return []string{"KUBECONFIG=/etc/rancher/k3s/k3s.yaml helm uninstall kube-prom-stack --namespace monitoring"}
+		},
+		status: "KUBECONFIG=/etc/rancher/k3s/k3s.yaml helm status kube-prom-stack --namespace monitoring",
+	})
+	RegisterAddon(shellAddon{
+		name: AddonCertManager,
+		validate: func(cluster Cluster) error {
+			version := cluster.addonVersion(AddonCertManager, defaultCertManagerVersion)
+			return requireBundleFiles(certManagerManifest(version, "cert-manager.crds.yaml"), certManagerManifest(version, "cert-manager.yaml"))
+		},
+		install: func(cluster Cluster) []string {
+			return []string{
+				"kubectl apply -f " + certManagerURL(cluster, "cert-manager.crds.yaml"),
+				"kubectl apply -f " + certManagerURL(cluster, "cert-manager.yaml"),
+				"sleep 30",
+			}
+		},
+		images: func(cluster Cluster, bundle string) ([]string, error) {
+			version := cluster.addonVersion(AddonCertManager, defaultCertManagerVersion)
+			data, err := os.ReadFile(filepath.Join(bundle, filepath.FromSlash(certManagerManifest(version, "cert-manager.yaml"))))
+			if err != nil {
+				return nil, err
+			}
+			return imageRefs(data)
+		},
+		uninstall: func(cluster Cluster) []string {
+			return []string{
+				"kubectl delete --ignore-not-found -f " + certManagerURL(cluster, "cert-manager.yaml"),
+				"kubectl delete --ignore-not-found -f " + certManagerURL(cluster, "cert-manager.crds.yaml"),
+			}
+		},
+		status: "kubectl get deployment cert-manager --namespace cert-manager",
+	})
+	RegisterAddon(shellAddon{
+		name:      AddonTraefik,
+		manifests: []string{"traefik-values.yaml"},
+		install: func(cluster Cluster) []string {
+			return []string{
+				"kubectl apply -f /tmp/yamls/traefik-values.yaml",
+				"while ! kubectl get deploy -n kube-system | grep -q traefik; do sleep 5; done; while [ $(kubectl get deploy -n kube-system | grep traefik | awk '{print $2}') != \"1/1\" ]; do sleep 5; done",
+			}
+		},
+		images: func(cluster Cluster, bundle string) ([]string, error) {
+			// The image traefik-values.yaml pins inside valuesContent, which imageRefs does not parse.
+			return []string{"rancher/mirrored-library-traefik:3.3.6"}, nil
+		},
+		uninstall: func(cluster Cluster) []string {
+			return []string{"kubectl delete --ignore-not-found -f /tmp/yamls/traefik-values.yaml"}
+		},
+		status: "kubectl get helmchart traefik --namespace kube-system",
+	})
+	RegisterAddon(shellAddon{
+		name:         AddonClusterIssuer,
+		dependencies: []string{AddonCertManager},
+		validate:     requireDomain,
+		manifests:    []string{"clusterissuer.yaml.tmpl"},
+		install: func(cluster Cluster) []string {
+			return []string{"kubectl apply -f /tmp/yamls/clusterissuer.yaml"}
+		},
+		uninstall: func(cluster Cluster) []string {
+			return []string{"kubectl delete --ignore-not-found clusterissuer letsencrypt-prod"}
+		},
+		status: "kubectl get clusterissuer letsencrypt-prod",
+	})
+	RegisterAddon(shellAddon{
+		name: AddonGitea,
+		validate: func(cluster Cluster) error {
+			pg := cluster.Gitea.Pg
+			var errs []error
+			for _, field := range []struct{ name, value string }{
+				{"user", pg.Username},
+				{"password", pg.Password},
+				{"db", pg.DbName},
+			} {
+				if field.value == "" {
+					errs = append(errs, fmt.Errorf("gitea.pg.%s is required", field.name))
+				}
+			}
+			return errors.Join(errs...)
+		},
+		manifests: []string{"gitea.yaml.tmpl"},
+		install: func(cluster Cluster) []string {
+			return []string{"kubectl apply -f /tmp/yamls/gitea.yaml"}
+		},
+		uninstall: func(cluster Cluster) []string {
+			return []string{"kubectl delete --ignore-not-found -f /tmp/yamls/gitea.yaml"}
+		},
+		status: "kubectl get deployment gitea",
+	})
+	RegisterAddon(shellAddon{
+		name:         AddonGiteaIngress,
+		dependencies: []string{AddonGitea},
+		validate:     requireDomain,
+		manifests:    []string{"gitea.ingress.yaml.tmpl"},
+		install: func(cluster Cluster) []string {
+			return []string{"kubectl apply -f /tmp/yamls/gitea.ingress.yaml"}
+		},
+		uninstall: func(cluster Cluster) []string {
+			return []string{"kubectl delete --ignore-not-found ingress git-tls-ingress"}
+		},
+		status: "kubectl get ingress git-tls-ingress",
+	})
+	RegisterAddon(linkerdAddon{name: AddonLinkerd})
+	RegisterAddon(linkerdAddon{name: AddonLinkerdMC, multicluster: true})
+}
+
+// shellAddon is an addon installed, removed and checked by shell commands run on the master node.
+type shellAddon struct {
+	name         string                         // Name of the addon.
+	dependencies []string                       // Names of the addons installed first.
+	validate     func(cluster Cluster) error    // Checks the cluster config; nil accepts any config.
+	manifests    []string                       // Embedded manifests rendered and uploaded before installing or removing the addon.
+	install      func(cluster Cluster) []string // Commands installing the addon.
+	uninstall    func(cluster Cluster) []string // Commands removing the addon.
+	status       string                         // Command that succeeds when the addon is installed.
+
+	// images lists the images the addon runs besides those its embedded manifests name, reading its
+	// charts and manifests from an air-gap bundle; nil for none.
+	images func(cluster Cluster, bundle string) ([]string, error)
+}
+
+// Name returns the name of the addon.
+func (a shellAddon) Name() string { return a.name }
+
+// Dependencies returns the names of the addons installed first.
+func (a shellAddon) Dependencies() []string { return a.dependencies }
+
+// Validate checks the cluster config the addon needs.
+func (a shellAddon) Validate(cluster Cluster) error {
+	if a.validate == nil {
+		return nil
+	}
+	return a.validate(cluster)
+}
+
+// Install renders and uploads the addon's manifests and runs its install commands on the master node.
+func (a shellAddon) Install(env AddonEnv) error {
+	manifests, err := a.renderManifests(env.Cluster)
+	if err != nil {
+		return err
+	}
+	if err := uploadManifests(env.Master, manifests); err != nil {
+		return err
+	}
+	return ExecuteCommands(env.Master, a.install(env.Cluster))
+}
+
+// Uninstall renders and uploads the addon's manifests and runs its uninstall commands on the master node.
+func (a shellAddon) Uninstall(env AddonEnv) error {
+	manifests, err := a.renderManifests(env.Cluster)
+	if err != nil {
+		return err
+	}
+	if err := uploadManifests(env.Master, manifests); err != nil {
+		return err
+	}
+	return ExecuteCommands(env.Master, a.uninstall(env.Cluster))
+}
+
+// renderManifests renders the addon's embedded manifests for a cluster.
+func (a shellAddon) renderManifests(cluster Cluster) ([]renderedManifest, error) {
+	manifests := make([]renderedManifest, 0, len(a.manifests))
+	for _, name := range a.manifests {
+		manifest, err := renderManifest(name, cluster)
+		if err != nil {
+			return nil, err
+		}
+		manifests = append(manifests, manifest)
+	}
+	return manifests, nil
+}
+
+// bundleImages lists the images the addon's embedded manifests name and those its images function adds.
+func (a shellAddon) bundleImages(cluster Cluster, bundle string) ([]string, error) {
+	manifests, err := a.renderManifests(cluster)
+	if err != nil {
+		return nil, err
+	}
+	var images []string
+	for _, manifest := range manifests {
+		refs, err := imageRefs(manifest.Data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", manifest.Name, err)
+		}
+		images = append(images, refs...)
+	}
+	if a.images == nil {
+		return images, nil
+	}
+	extra, err := a.images(cluster, bundle)
+	if err != nil {
+		return nil, err
+	}
+	return append(images, extra...), nil
+}
+
+// Status runs the addon's status command on the master node; a non-zero exit means it is not installed.
+func (a shellAddon) Status(env AddonEnv) (bool, error) {
+	_, err := env.Master.Output(a.status)
+	var exitErr *ssh.ExitError
+	if errors.As(err, &exitErr) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// linkerdAddon installs Linkerd, optionally with multi-cluster support, from this machine
+// against the cluster's kubeconfig.
+type linkerdAddon struct {
+	name         string // Name of the addon.
+	multicluster bool   // Whether to install the multi-cluster extension.
+}
+
+// Name returns the name of the addon.
+func (a linkerdAddon) Name() string { return a.name }
+
+// Dependencies returns no dependencies; the multi-cluster install includes the Linkerd control plane.
+func (a linkerdAddon) Dependencies() []string { return nil }
+
+// Validate rejects air-gapped installs: the linkerd CLI pulls its images from cr.l5d.io, which the bundle cannot stand in for.
+func (a linkerdAddon) Validate(cluster Cluster) error {
+	if airgapped() {
+		return errors.New("cannot be installed from an airgap bundle; its images come from cr.l5d.io")
+	}
+	return nil
+}
+
+// Install generates the certificates and installs Linkerd with the local linkerd CLI.
+func (a linkerdAddon) Install(env AddonEnv) error {
+	return runLinkerdInstall(env.Cluster, env.Logger, a.multicluster)
+}
+
+// Uninstall removes Linkerd, and its multi-cluster extension if enabled, with the local linkerd CLI.
+func (a linkerdAddon) Uninstall(env AddonEnv) error {
+	commands := [][]string{{"uninstall"}}
+	if a.multicluster {
+		commands = [][]string{{"multicluster", "uninstall"}, {"uninstall"}}
+	}
+	for _, args := range commands {
+		kubeconfig := shellQuote(env.Kubeconfig)
+		script := fmt.Sprintf("linkerd %s --kubeconfig %s | kubectl --kubeconfig %s delete --ignore-not-found -f -", strings.Join(args, " "), kubeconfig, kubeconfig)
+		if out, err := exec.Command("sh", "-c", script).CombinedOutput(); err != nil {
+			return fmt.Errorf("linkerd %s: %v: %s", strings.Join(args, " "), err, out)
+		}
+	}
+	return nil
+}
+
+// Status reports whether the Linkerd namespace, or the multi-cluster one, exists.
+func (a linkerdAddon) Status(env AddonEnv) (bool, error) {
+	namespace := "linkerd"
+	if a.multicluster {
+		namespace = "linkerd-multicluster"
+	}
+	err := exec.Command("kubectl", "--kubeconfig", env.Kubeconfig, "get", "namespace", namespace).Run()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// certManagerURL returns where a manifest of the cluster's cert-manager release is applied from:
+// its GitHub release or, in air-gapped mode, the uploaded bundle.
+func certManagerURL(cluster Cluster, file string) string {
+	version := cluster.addonVersion(AddonCertManager, defaultCertManagerVersion)
+	if airgapped() {
+		return airgapPath(certManagerManifest(version, file))
+	}
+	return fmt.Sprintf("https://github.com/cert-manager/cert-manager/releases/download/%s/%s", version, file)
+}
+
+// requireDomain checks that the cluster has a domain.
+func requireDomain(cluster Cluster) error {
+	if cluster.Domain == "" {
+		return errors.New("domain is required")
+	}
+	return nil
+}
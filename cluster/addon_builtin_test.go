@@ -0,0 +1,41 @@
+package cluster
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLinkerdUninstallQuotesKubeconfig(t *testing.T) {
+	bin, calls := t.TempDir(), t.TempDir()
+	// Stand-ins for the CLIs, recording the arguments of each call one per line in a file named after them.
+	for _, name := range []string{"linkerd", "kubectl"} {
+		script := "#!/bin/sh\nprintf '%s\\n' \"$@\" >> \"$CALLS/" + name + "\"\ncat > /dev/null\n"
+		if err := os.WriteFile(filepath.Join(bin, name), []byte(script), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+	t.Setenv("CALLS", calls)
+
+	kubeconfig := filepath.Join(t.TempDir(), `it's "$HOME" config`)
+	env := AddonEnv{Kubeconfig: kubeconfig, Logger: newTestLogger()}
+	if err := (linkerdAddon{name: AddonLinkerdMC, multicluster: true}).Uninstall(env); err != nil {
+		t.Fatalf("Uninstall: %v", err)
+	}
+
+	want := map[string][]string{
+		"linkerd": {"multicluster", "uninstall", "--kubeconfig", kubeconfig, "uninstall", "--kubeconfig", kubeconfig},
+		"kubectl": {"--kubeconfig", kubeconfig, "delete", "--ignore-not-found", "-f", "-", "--kubeconfig", kubeconfig, "delete", "--ignore-not-found", "-f", "-"},
+	}
+	for name, args := range want {
+		data, err := os.ReadFile(filepath.Join(calls, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.TrimSuffix(string(data), "\n"); got != strings.Join(args, "\n") {
+			t.Errorf("%s arguments =\n%s\nwant\n%s", name, got, strings.Join(args, "\n"))
+		}
+	}
+}
@@ -0,0 +1,307 @@
+package cluster
+
+import (
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// extraAddonsDir is the directory on the master node that extra addon files are uploaded to.
+const extraAddonsDir = "/tmp/k3sd/addons"
+
+// ExtraAddon is an addon declared in the config: a Helm chart or a directory of manifests,
+// installed on the master node after k3s is up.
+//
+// Fields:
+//   - Name: The name of the addon, used as the Helm release name and the provisioning step name.
+//   - Dependencies: The names of the addons installed first.
+//   - Helm: The Helm chart to install.
+//   - Manifests: A local directory of YAML or JSON manifests to apply, relative to the config.
+type ExtraAddon struct {
+	Name         string     `json:"name"`                   // Name of the addon, release and step.
+	Dependencies []string   `json:"dependencies,omitempty"` // Names of the addons installed first.
+	Helm         *HelmChart `json:"helm,omitempty"`         // Helm chart to install.
+	Manifests    string     `json:"manifests,omitempty"`    // Local directory of manifests to apply.
+}
+
+// HelmChart is a reference to a Helm chart and the values it is installed with.
+//
+// Fields:
+//   - Repo: The URL of the chart repository; empty for a chart given as an OCI reference or a URL.
+//   - Chart: The name of the chart in the repository, or an OCI reference.
+//   - Version: The chart version; the latest if empty.
+//   - Namespace: The namespace of the release, created if missing; "default" if empty.
+//   - Values: A local values file, relative to the config.
+type HelmChart struct {
+	Repo      string `json:"repo,omitempty"`      // URL of the chart repository.
+	Chart     string `json:"chart"`               // Name of the chart, or an OCI reference.
+	Version   string `json:"version,omitempty"`   // Chart version; the latest if empty.
+	Namespace string `json:"namespace,omitempty"` // Namespace of the release; "default" if empty.
+	Values    string `json:"values,omitempty"`    // Local values file.
+}
+
+// declaredAddon adapts an ExtraAddon from the config to the Addon interface.
+type declaredAddon struct {
+	ExtraAddon
+}
+
+// Name returns the name of the addon.
+func (a declaredAddon) Name() string { return a.ExtraAddon.Name }
+
+// Dependencies returns the names of the addons installed first.
+func (a declaredAddon) Dependencies() []string { return a.ExtraAddon.Dependencies }
+
+// Validate checks that the addon declares either a chart or a manifest directory, and that its local files exist.
+func (a declaredAddon) Validate(cluster Cluster) error {
+	switch {
+	case a.Helm != nil && a.Manifests != "":
+		return errors.New("helm and manifests are mutually exclusive")
+	case a.Helm != nil:
+		if a.Helm.Chart == "" {
+			return errors.New("helm.chart is required")
+		}
+		if err := requireBundleFiles(bundleHelm, a.bundleChart()); err != nil {
+			return err
+		}
+		if a.Helm.Values != "" {
+			if _, err := os.Stat(a.Helm.Values); err != nil {
+				return fmt.Errorf("helm.values: %w", err)
+			}
+		}
+		return nil
+	case a.Manifests != "":
+		files, err := a.manifestFiles()
+		if err != nil {
+			return fmt.Errorf("manifests: %w", err)
+		}
+		if len(files) == 0 {
+			return fmt.Errorf("manifests: no .yaml, .yml or .json files in %s", a.Manifests)
+		}
+		return nil
+	}
+	return errors.New("either helm or manifests is required")
+}
+
+// Install uploads the addon's local files to the master node and installs the chart, from its repository
+// or, in air-gapped mode, from the uploaded bundle, or applies the manifests.
+func (a declaredAddon) Install(env AddonEnv) error {
+	if err := a.upload(env.Master); err != nil {
+		return err
+	}
+	if a.Helm != nil {
+		if airgapped() {
+			// airgapStep installed helm and uploaded the chart with the bundle.
+			return ExecuteCommands(env.Master, []string{helmCommand(a.helmArgs(airgapPath(a.bundleChart()))...)})
+		}
+		args := a.helmArgs(a.Helm.Chart)
+		if a.Helm.Repo != "" {
+			args = append(args, "--repo", a.Helm.Repo)
+		}
+		if a.Helm.Version != "" {
+			args = append(args, "--version", a.Helm.Version)
+		}
+		return ExecuteCommands(env.Master, []string{
+			"command -v helm >/dev/null || curl -fsSL https://raw.githubusercontent.com/helm/helm/main/scripts/get-helm-3 | bash",
+			helmCommand(args...),
+		})
+	}
+	return ExecuteCommands(env.Master, []string{"kubectl apply -R -f " + shellQuote(a.remoteDir())})
+}
+
+// Uninstall uninstalls the chart, or deletes the resources of the manifests.
+func (a declaredAddon) Uninstall(env AddonEnv) error {
+	if a.Helm != nil {
+		return ExecuteCommands(env.Master, []string{helmCommand("uninstall", a.ExtraAddon.Name, "--namespace", a.namespace(), "--ignore-not-found")})
+	}
+	if err := a.upload(env.Master); err != nil {
+		return err
+	}
+	return ExecuteCommands(env.Master, []string{"kubectl delete --ignore-not-found -R -f " + shellQuote(a.remoteDir())})
+}
+
+// Status reports whether the release, or every resource of the manifests, exists.
+func (a declaredAddon) Status(env AddonEnv) (bool, error) {
+	cmd := helmCommand("status", a.ExtraAddon.Name, "--namespace", a.namespace())
+	if a.Helm == nil {
+		if err := a.upload(env.Master); err != nil {
+			return false, err
+		}
+		cmd = "kubectl get -R -f " + shellQuote(a.remoteDir())
+	}
+	_, err := env.Master.Output(cmd)
+	var exitErr *ssh.ExitError
+	if errors.As(err, &exitErr) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// bundleImages lists the images the chart runs, as listed in the air-gap bundle when it was built,
+// or the images the manifests name.
+func (a declaredAddon) bundleImages(cluster Cluster, bundle string) ([]string, error) {
+	if a.Helm != nil {
+		return chartImages(bundle, a.bundleChart())
+	}
+	files, err := a.manifestFiles()
+	if err != nil {
+		return nil, fmt.Errorf("manifests: %w", err)
+	}
+	var images []string
+	for _, rel := range files {
+		data, err := os.ReadFile(filepath.Join(a.Manifests, rel))
+		if err != nil {
+			return nil, fmt.Errorf("read manifest: %w", err)
+		}
+		refs, err := imageRefs(data)
+		if err != nil {
+			return nil, fmt.Errorf("manifest %s: %w", rel, err)
+		}
+		images = append(images, refs...)
+	}
+	return images, nil
+}
+
+// upload copies the addon's values file or manifests to its directory on the master node.
+//
+// Parameters:
+//   - master: The Executor for the master node.
+//
+// Returns:
+//   - error: An error if a local file cannot be read or uploaded.
+func (a ExtraAddon) upload(master Executor) error {
+	if err := ExecuteCommands(master, []string{"rm -rf " + shellQuote(a.remoteDir())}); err != nil {
+		return err
+	}
+	if a.Helm != nil {
+		if a.Helm.Values == "" {
+			return nil
+		}
+		data, err := os.ReadFile(a.Helm.Values)
+		if err != nil {
+			return fmt.Errorf("read values: %w", err)
+		}
+		return master.Upload(a.remoteDir()+"/values.yaml", data, 0600)
+	}
+
+	files, err := a.manifestFiles()
+	if err != nil {
+		return err
+	}
+	for _, rel := range files {
+		data, err := os.ReadFile(filepath.Join(a.Manifests, rel))
+		if err != nil {
+			return fmt.Errorf("read manifest: %w", err)
+		}
+		if err := master.Upload(path.Join(a.remoteDir(), filepath.ToSlash(rel)), data, 0600); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// manifestFiles lists the YAML and JSON files under the addon's manifest directory.
+//
+// Returns:
+//   - []string: The paths of the files, relative to the directory.
+//   - error: An error if the directory cannot be read.
+func (a ExtraAddon) manifestFiles() ([]string, error) {
+	var files []string
+	err := filepath.WalkDir(a.Manifests, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		switch strings.ToLower(filepath.Ext(p)) {
+		case ".yaml", ".yml", ".json":
+			rel, err := filepath.Rel(a.Manifests, p)
+			if err != nil {
+				return err
+			}
+			files = append(files, rel)
+		}
+		return nil
+	})
+	return files, err
+}
+
+// remoteDir returns the directory on the master node the addon's files are uploaded to.
+func (a ExtraAddon) remoteDir() string {
+	return path.Join(extraAddonsDir, a.Name)
+}
+
+// helmArgs returns the arguments of the helm command installing or upgrading the addon's release from a chart.
+func (a ExtraAddon) helmArgs(chart string) []string {
+	args := []string{"upgrade", "--install", a.Name, chart, "--namespace", a.namespace(), "--create-namespace"}
+	if a.Helm.Values != "" {
+		args = append(args, "-f", a.remoteDir()+"/values.yaml")
+	}
+	return args
+}
+
+// bundleChart returns the path in the air-gap bundle of the addon's chart, one per version.
+func (a ExtraAddon) bundleChart() string {
+	name := a.Name
+	if a.Helm.Version != "" {
+		name += "-" + a.Helm.Version
+	}
+	return path.Join(bundleCharts, "addons", name+".tgz")
+}
+
+// namespace returns the namespace of the addon's Helm release.
+func (a ExtraAddon) namespace() string {
+	if a.Helm.Namespace == "" {
+		return "default"
+	}
+	return a.Helm.Namespace
+}
+
+// resolveAddonPaths makes the local paths of the clusters' extra addons relative to the config's directory.
+//
+// Parameters:
+//   - path: The path of the config.
+//   - clusters: The slice of Cluster objects to update in place.
+func resolveAddonPaths(path string, clusters []Cluster) {
+	for ci := range clusters {
+		for ai := range clusters[ci].ExtraAddons {
+			addon := &clusters[ci].ExtraAddons[ai]
+			resolveLocalPath(path, &addon.Manifests)
+			if addon.Helm != nil {
+				resolveLocalPath(path, &addon.Helm.Values)
+			}
+		}
+	}
+}
+
+// resolveLocalPath expands a leading "~/" in a local path of the config and makes it relative to the config's directory.
+//
+// Parameters:
+//   - path: The path of the config.
+//   - p: A pointer to the local path to update in place; left alone if empty.
+func resolveLocalPath(path string, p *string) {
+	if *p == "" {
+		return
+	}
+	*p = expandHome(*p)
+	if !filepath.IsAbs(*p) {
+		*p = filepath.Join(filepath.Dir(path), *p)
+	}
+}
+
+// helmCommand builds a helm command run against the cluster's kubeconfig on the master node.
+//
+// Parameters:
+//   - args: The helm arguments, quoted for the shell.
+//
+// Returns:
+//   - string: The command.
+func helmCommand(args ...string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = shellQuote(arg)
+	}
+	return "KUBECONFIG=/etc/rancher/k3s/k3s.yaml helm " + strings.Join(quoted, " ")
+}
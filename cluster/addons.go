@@ -0,0 +1,141 @@
+package cluster
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/argon-chat/k3sd/utils"
+	"gopkg.in/yaml.v3"
+)
+
+// Names of the addons accepted in a cluster's addons block.
+const (
+	AddonCertManager   = "certManager"
+	AddonTraefik       = "traefik"
+	AddonClusterIssuer = "clusterIssuer"
+	AddonPrometheus    = "prometheus"
+	AddonGitea         = "gitea"
+	AddonGiteaIngress  = "giteaIngress"
+	AddonLinkerd       = "linkerd"
+	AddonLinkerdMC     = "linkerdMulticluster"
+)
+
+// Versions installed when a cluster does not pin one.
+const (
+	defaultPrometheusVersion  = "35.5.1"  // kube-prometheus-stack chart version.
+	defaultCertManagerVersion = "v1.17.2" // cert-manager release.
+)
+
+// addonFlags maps each addon to the utils.Flags key of the CLI flag that enables it by default.
+var addonFlags = map[string]string{
+	AddonCertManager:   "cert-manager",
+	AddonTraefik:       "traefik-values",
+	AddonClusterIssuer: "clusterissuer",
+	AddonPrometheus:    "prometheus",
+	AddonGitea:         "gitea",
+	AddonGiteaIngress:  "gitea-ingress",
+	AddonLinkerd:       "linkerd",
+	AddonLinkerdMC:     "linkerd-mc",
+}
+
+// AddonConfig selects an addon for a cluster. In the config it is either a boolean, or an object
+// of settings that enables the addon unless it sets "enabled" to false.
+//
+// Fields:
+//   - Enabled: Whether the addon is installed; nil defers to the CLI flag.
+//   - Version: The version to install, for addons that support pinning one.
+//   - Pg: The PostgreSQL configuration of gitea, given here instead of in the cluster's gitea field.
+type AddonConfig struct {
+	Enabled *bool  `json:"enabled,omitempty"` // Whether the addon is installed; nil defers to the CLI flag.
+	Version string `json:"version,omitempty"` // Version to install, for addons that support pinning one.
+	Pg      *Pg    `json:"pg,omitempty"`      // PostgreSQL configuration of gitea.
+}
+
+// UnmarshalJSON decodes an addon given as a boolean or as an object of settings.
+//
+// Parameters:
+//   - data: The JSON value.
+//
+// Returns:
+//   - error: An error if the value is neither a boolean nor an object.
+func (a *AddonConfig) UnmarshalJSON(data []byte) error {
+	var enabled bool
+	if err := json.Unmarshal(data, &enabled); err == nil {
+		a.Enabled = &enabled
+		return nil
+	}
+	type settings AddonConfig
+	var s settings
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("addon must be a boolean or an object: %w", err)
+	}
+	if s.Enabled == nil {
+		s.Enabled = new(bool)
+		*s.Enabled = true
+	}
+	*a = AddonConfig(s)
+	return nil
+}
+
+// addonEnabled reports whether an addon is installed on the cluster. A setting in the cluster's
+// addons block wins; otherwise addons declared in extraAddons are enabled and built-in ones
+// follow their CLI flag.
+//
+// Parameters:
+//   - name: The name of the addon.
+//
+// Returns:
+//   - bool: True if the addon is enabled.
+func (c Cluster) addonEnabled(name string) bool {
+	if addon, ok := c.Addons[name]; ok && addon.Enabled != nil {
+		return *addon.Enabled
+	}
+	for _, extra := range c.ExtraAddons {
+		if extra.Name == name {
+			return true
+		}
+	}
+	return utils.Flags[addonFlags[name]]
+}
+
+// addonVersion returns the version of an addon pinned in the cluster's addons block.
+//
+// Parameters:
+//   - name: The name of the addon.
+//   - fallback: The version used when none is pinned.
+//
+// Returns:
+//   - string: The pinned version, or the fallback.
+func (c Cluster) addonVersion(name, fallback string) string {
+	if version := c.Addons[name].Version; version != "" {
+		return version
+	}
+	return fallback
+}
+
+// mergeAddonSettings copies the settings given in the addons block into the cluster fields the addons
+// read, so that gitea's PostgreSQL configuration may be set under addons.gitea instead of gitea.
+//
+// Parameters:
+//   - path: The path of the config, used to locate errors.
+//   - root: The root node of the config, used to locate errors.
+//   - clusters: The decoded clusters, updated in place.
+//
+// Returns:
+//   - ConfigErrors: An error for every cluster that sets gitea's PostgreSQL configuration in both places, or nil.
+func mergeAddonSettings(path string, root *yaml.Node, clusters []Cluster) ConfigErrors {
+	var errs ConfigErrors
+	for ci := range clusters {
+		cluster := &clusters[ci]
+		pg := cluster.Addons[AddonGitea].Pg
+		if pg == nil {
+			continue
+		}
+		if cluster.Gitea.Pg != (Pg{}) {
+			errs = append(errs, locatedError(path, root, fmt.Sprintf("%s/%d/addons/%s/pg", clustersPointer(root), ci, AddonGitea),
+				"gitea.pg is also set at the top level of the cluster; set it in one place"))
+			continue
+		}
+		cluster.Gitea.Pg = *pg
+	}
+	return errs
+}
@@ -0,0 +1,722 @@
+package cluster
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"github.com/argon-chat/k3sd/utils"
+	"io"
+	"io/fs"
+	"maps"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Paths on the nodes used by an air-gapped install.
+const (
+	airgapDir    = "/tmp/k3sd/airgap"                  // Directory the bundle is uploaded to.
+	k3sImagesDir = "/var/lib/rancher/k3s/agent/images" // Directory k3s imports image tarballs from on start.
+)
+
+// Layout of an air-gap bundle, relative to its directory.
+const (
+	bundleInstallScript = "install.sh"  // The k3s install script, from get.k3s.io.
+	bundleK3s           = "k3s"         // The k3s binary for the nodes' architecture.
+	bundleHelm          = "helm"        // The helm binary, needed by Helm chart addons.
+	bundleImages        = "images"      // Image tarballs imported by k3s on every node.
+	bundleCharts        = "charts"      // Helm charts of the addons, as .tgz archives.
+	bundleManifests     = "manifests"   // Remote manifests of the addons.
+	bundleVersion       = "k3s-version" // The k3s release of the binary and images, e.g. v1.32.3+k3s1.
+)
+
+// defaultHelmVersion is the helm release packaged into air-gap bundles.
+const defaultHelmVersion = "v3.17.3"
+
+// airgapped reports whether k3sd installs from an air-gap bundle instead of the internet.
+func airgapped() bool {
+	return utils.AirgapBundle != ""
+}
+
+// airgapPath returns the path on a node of a file of the uploaded air-gap bundle.
+//
+// Parameters:
+//   - rel: The path of the file in the bundle.
+//
+// Returns:
+//   - string: The path on the node.
+func airgapPath(rel string) string {
+	return path.Join(airgapDir, rel)
+}
+
+// prometheusChart returns the path in the air-gap bundle of a kube-prometheus-stack chart version.
+func prometheusChart(version string) string {
+	return path.Join(bundleCharts, fmt.Sprintf("kube-prometheus-stack-%s.tgz", version))
+}
+
+// certManagerManifest returns the path in the air-gap bundle of a cert-manager release manifest.
+func certManagerManifest(version, file string) string {
+	return path.Join(bundleManifests, "cert-manager", version, file)
+}
+
+// k3sInstallCommand returns the command installing k3s on a node, from get.k3s.io at the cluster's
+// pinned version or channel or, in air-gapped mode, from the uploaded bundle with INSTALL_K3S_SKIP_DOWNLOAD.
+//
+// Parameters:
+//   - cluster: The cluster the node belongs to.
+//   - env: The INSTALL_K3S_* and K3S_* variables passed to the install script.
+//
+// Returns:
+//   - string: The command.
+func k3sInstallCommand(cluster Cluster, env string) string {
+	if airgapped() {
+		return fmt.Sprintf("INSTALL_K3S_SKIP_DOWNLOAD=true %s sh %s", env, airgapPath(bundleInstallScript))
+	}
+	switch {
+	case cluster.K3sVersion != "":
+		env = fmt.Sprintf("INSTALL_K3S_VERSION=%s %s", shellQuote(cluster.K3sVersion), env)
+	case cluster.K3sChannel != "":
+		env = fmt.Sprintf("INSTALL_K3S_CHANNEL=%s %s", shellQuote(cluster.K3sChannel), env)
+	}
+	return fmt.Sprintf("curl -sfL https://get.k3s.io | %s sh -", env)
+}
+
+// airgapStep returns the step uploading the air-gap bundle to a node and putting the k3s binary
+// and images where the install script and k3s expect them. Servers also get the helm binary,
+// charts and manifests used by the addons.
+//
+// Parameters:
+//   - client: The Executor for the node.
+//   - server: Whether the node is the cluster's server, where addons are installed.
+//
+// Returns:
+//   - step: The "airgap-bundle" step.
+func airgapStep(client Executor, server bool) step {
+	return step{name: "airgap-bundle", run: func() error {
+		files, err := bundleFiles(utils.AirgapBundle)
+		if err != nil {
+			return fmt.Errorf("read airgap bundle: %w", err)
+		}
+		hasImages, hasHelm := false, false
+		for _, rel := range files {
+			top, _, _ := strings.Cut(rel, "/")
+			switch {
+			case rel == bundleInstallScript || rel == bundleK3s:
+			case top == bundleImages:
+				hasImages = true
+			case server && rel == bundleHelm:
+				hasHelm = true
+			case server && (top == bundleCharts || top == bundleManifests):
+			default:
+				continue
+			}
+			mode := os.FileMode(0644)
+			if rel == bundleInstallScript || rel == bundleK3s || rel == bundleHelm {
+				mode = 0755
+			}
+			if err := uploadBundleFile(client, rel, mode); err != nil {
+				return err
+			}
+		}
+
+		commands := []string{fmt.Sprintf("sudo install -m 0755 %s /usr/local/bin/k3s", airgapPath(bundleK3s))}
+		if hasImages {
+			commands = append(commands, fmt.Sprintf("sudo mkdir -p %s && sudo cp %s/* %s/", k3sImagesDir, airgapPath(bundleImages), k3sImagesDir))
+		}
+		if hasHelm {
+			commands = append(commands, fmt.Sprintf("sudo install -m 0755 %s /usr/local/bin/helm", airgapPath(bundleHelm)))
+		}
+		return ExecuteCommands(client, commands)
+	}}
+}
+
+// uploadBundleFile streams a file of the air-gap bundle to its place on a node, so that image
+// tarballs of several hundred megabytes are never held in memory.
+//
+// Parameters:
+//   - client: The Executor for the node.
+//   - rel: The path of the file in the bundle.
+//   - mode: The permission bits of the file on the node.
+//
+// Returns:
+//   - error: An error if the file cannot be read or uploaded.
+func uploadBundleFile(client Executor, rel string, mode os.FileMode) error {
+	file, err := os.Open(filepath.Join(utils.AirgapBundle, filepath.FromSlash(rel)))
+	if err != nil {
+		return fmt.Errorf("read airgap bundle: %w", err)
+	}
+	defer file.Close()
+	return client.UploadStream(airgapPath(rel), file, mode)
+}
+
+// bundleFiles lists the files of an air-gap bundle.
+//
+// Parameters:
+//   - dir: The directory of the bundle.
+//
+// Returns:
+//   - []string: The slash-separated paths of the files, relative to the directory.
+//   - error: An error if the directory cannot be read.
+func bundleFiles(dir string) ([]string, error) {
+	var files []string
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		files = append(files, filepath.ToSlash(rel))
+		return nil
+	})
+	return files, err
+}
+
+// requireBundleFiles checks that an air-gap bundle holds the given files, if k3sd runs air-gapped.
+//
+// Parameters:
+//   - files: The paths of the files in the bundle.
+//
+// Returns:
+//   - error: An error naming the missing files, or nil.
+func requireBundleFiles(files ...string) error {
+	if !airgapped() {
+		return nil
+	}
+	var missing []string
+	for _, rel := range files {
+		if _, err := os.Stat(filepath.Join(utils.AirgapBundle, filepath.FromSlash(rel))); err != nil {
+			missing = append(missing, rel)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("airgap bundle %s has no %s; run k3sd bundle to build it", utils.AirgapBundle, strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// airgapProblems checks that the air-gap bundle holds what every node needs, if k3sd runs air-gapped.
+//
+// Returns:
+//   - []string: A description of every problem found, or nil.
+func airgapProblems() []string {
+	if !airgapped() {
+		return nil
+	}
+	var problems []string
+	if err := requireBundleFiles(bundleInstallScript, bundleK3s, bundleVersion); err != nil {
+		problems = append(problems, err.Error())
+	}
+	images, _ := filepath.Glob(filepath.Join(utils.AirgapBundle, bundleImages, "*"))
+	if len(images) == 0 {
+		problems = append(problems, fmt.Sprintf("airgap bundle %s has no image tarballs in %s/", utils.AirgapBundle, bundleImages))
+	}
+	return problems
+}
+
+// BuildAirgapBundle downloads into a directory everything the enabled addons and an air-gapped
+// install of the clusters need: the k3s install script, binary and images, and, if an addon
+// needs them, the helm binary, the addons' charts and manifests, and the images the addons run.
+// The charts are rendered with a helm binary for this machine, from PATH or downloaded, to list their images.
+//
+// Parameters:
+//   - dir: The directory of the bundle, created if missing.
+//   - k3sVersion: The k3s release to package, e.g. v1.32.3+k3s1; if empty, the one the clusters pin.
+//   - arch: The architecture of the nodes: amd64, arm64 or arm.
+//   - clusters: The clusters whose enabled addons are packaged.
+//   - logger: A pointer to a utils.Logger instance for logging operations.
+//
+// Returns:
+//   - error: An error if the architecture is unknown, the addons cannot be resolved, a download fails,
+//     or a chart cannot be pulled or rendered.
+func BuildAirgapBundle(dir, k3sVersion, arch string, clusters []Cluster, logger *utils.Logger) error {
+	k3sBinary, ok := map[string]string{"amd64": "k3s", "arm64": "k3s-arm64", "arm": "k3s-armhf"}[arch]
+	if !ok {
+		return fmt.Errorf("unknown architecture %q, want amd64, arm64 or arm", arch)
+	}
+	if k3sVersion == "" {
+		version, err := bundleK3sVersion(clusters)
+		if err != nil {
+			return err
+		}
+		k3sVersion = version
+	}
+
+	downloads := map[string]string{
+		bundleInstallScript: "https://get.k3s.io",
+		bundleK3s:           k3sReleaseURL(k3sVersion, k3sBinary),
+		path.Join(bundleImages, fmt.Sprintf("k3s-airgap-images-%s.tar.zst", arch)): k3sReleaseURL(k3sVersion, fmt.Sprintf("k3s-airgap-images-%s.tar.zst", arch)),
+	}
+	var charts []bundledChart
+	var pulls []declaredAddon
+	for _, cluster := range clusters {
+		addons, err := clusterAddons(cluster)
+		if err != nil {
+			return fmt.Errorf("%s: %w", cluster.NodeName, err)
+		}
+		for _, addon := range addons {
+			switch addon.Name() {
+			case AddonPrometheus:
+				version := cluster.addonVersion(AddonPrometheus, defaultPrometheusVersion)
+				downloads[prometheusChart(version)] = fmt.Sprintf("https://github.com/prometheus-community/helm-charts/releases/download/kube-prometheus-stack-%s/kube-prometheus-stack-%s.tgz", version, version)
+			case AddonCertManager:
+				version := cluster.addonVersion(AddonCertManager, defaultCertManagerVersion)
+				for _, file := range []string{"cert-manager.crds.yaml", "cert-manager.yaml"} {
+					downloads[certManagerManifest(version, file)] = fmt.Sprintf("https://github.com/cert-manager/cert-manager/releases/download/%s/%s", version, file)
+				}
+			}
+			if declared, ok := addon.(declaredAddon); ok && declared.Helm != nil {
+				pulls = append(pulls, declared)
+			}
+			chart, ok, err := addonChart(cluster, addon)
+			if err != nil {
+				return fmt.Errorf("%s: %s addon: %w", cluster.NodeName, addon.Name(), err)
+			}
+			if ok {
+				charts = append(charts, chart)
+			}
+		}
+	}
+
+	for rel, url := range downloads {
+		logger.Log("Downloading %s", url)
+		if err := download(url, filepath.Join(dir, filepath.FromSlash(rel))); err != nil {
+			return err
+		}
+	}
+	if len(charts) > 0 {
+		url := fmt.Sprintf("https://get.helm.sh/helm-%s-linux-%s.tar.gz", defaultHelmVersion, arch)
+		logger.Log("Downloading %s", url)
+		if err := downloadHelm(url, fmt.Sprintf("linux-%s/helm", arch), filepath.Join(dir, bundleHelm)); err != nil {
+			return err
+		}
+
+		tmp, err := os.MkdirTemp("", "k3sd-bundle")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(tmp)
+		helm, err := localHelm(tmp)
+		if err != nil {
+			return err
+		}
+		for _, addon := range pulls {
+			logger.Log("Pulling chart %s", addon.Helm.Chart)
+			if err := pullChart(helm, *addon.Helm, filepath.Join(dir, filepath.FromSlash(addon.bundleChart()))); err != nil {
+				return err
+			}
+		}
+		for _, chart := range charts {
+			logger.Log("Listing the images of %s", chart.file)
+			if err := renderChartImages(helm, tmp, dir, chart); err != nil {
+				return err
+			}
+		}
+	}
+
+	images := map[string]imageRef{}
+	for _, cluster := range clusters {
+		addons, _ := clusterAddons(cluster)
+		for _, addon := range addons {
+			bundler, ok := addon.(imageBundler)
+			if !ok {
+				continue
+			}
+			refs, err := bundler.bundleImages(cluster, dir)
+			if err != nil {
+				return fmt.Errorf("%s: %s addon: %w", cluster.NodeName, addon.Name(), err)
+			}
+			for _, image := range refs {
+				ref, err := parseImageRef(image)
+				if err != nil {
+					return fmt.Errorf("%s: %s addon: %w", cluster.NodeName, addon.Name(), err)
+				}
+				images[ref.String()] = ref
+			}
+		}
+	}
+	for _, name := range slices.Sorted(maps.Keys(images)) {
+		logger.Log("Pulling image %s", name)
+		if err := pullImage(images[name], arch, filepath.Join(dir, filepath.FromSlash(images[name].file()))); err != nil {
+			return err
+		}
+	}
+	if err := os.WriteFile(filepath.Join(dir, bundleVersion), []byte(k3sVersion+"\n"), 0644); err != nil {
+		return err
+	}
+	logger.Log("Airgap bundle for k3s %s written to %s", k3sVersion, dir)
+	return nil
+}
+
+// bundledK3sVersion reads the k3s release the air-gap bundle holds, recorded by BuildAirgapBundle.
+//
+// Returns:
+//   - string: The version, e.g. v1.32.3+k3s1.
+//   - error: An error if the bundle records no version.
+func bundledK3sVersion() (string, error) {
+	data, err := os.ReadFile(filepath.Join(utils.AirgapBundle, bundleVersion))
+	if err != nil {
+		return "", fmt.Errorf("airgap bundle %s has no %s; run k3sd bundle to build it", utils.AirgapBundle, bundleVersion)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// imageBundler is implemented by addons that run container images, so that air-gap bundles carry them.
+type imageBundler interface {
+	// bundleImages lists the images the addon runs on a cluster, reading its charts and manifests
+	// from the air-gap bundle in a directory.
+	bundleImages(cluster Cluster, bundle string) ([]string, error)
+}
+
+// bundledChart is a Helm chart an addon installs from the air-gap bundle.
+//
+// Fields:
+//   - file: The path of the chart archive in the bundle.
+//   - release: The name of the Helm release.
+//   - namespace: The namespace of the release.
+//   - values: The values the chart is installed with, or nil.
+type bundledChart struct {
+	file, release, namespace string
+	values                   []byte
+}
+
+// addonChart returns the Helm chart an addon installs from the air-gap bundle, if it installs one.
+//
+// Parameters:
+//   - cluster: The cluster the addon is enabled on.
+//   - addon: The addon.
+//
+// Returns:
+//   - bundledChart: The chart.
+//   - bool: True if the addon installs a chart.
+//   - error: An error if the values of the chart cannot be read or rendered.
+func addonChart(cluster Cluster, addon Addon) (bundledChart, bool, error) {
+	if addon.Name() == AddonPrometheus {
+		values, err := renderManifest("prom-stack-values.yaml", cluster)
+		if err != nil {
+			return bundledChart{}, false, err
+		}
+		file := prometheusChart(cluster.addonVersion(AddonPrometheus, defaultPrometheusVersion))
+		return bundledChart{file: file, release: "kube-prom-stack", namespace: "monitoring", values: values.Data}, true, nil
+	}
+	declared, ok := addon.(declaredAddon)
+	if !ok || declared.Helm == nil {
+		return bundledChart{}, false, nil
+	}
+	chart := bundledChart{file: declared.bundleChart(), release: declared.ExtraAddon.Name, namespace: declared.namespace()}
+	if declared.Helm.Values != "" {
+		values, err := os.ReadFile(declared.Helm.Values)
+		if err != nil {
+			return bundledChart{}, false, fmt.Errorf("helm.values: %w", err)
+		}
+		chart.values = values
+	}
+	return chart, true, nil
+}
+
+// chartImagesFile returns the path in the air-gap bundle of the list of images a bundled chart runs.
+func chartImagesFile(chart string) string {
+	return strings.TrimSuffix(chart, ".tgz") + ".images"
+}
+
+// chartImages reads the list of images a bundled chart runs, written by BuildAirgapBundle.
+//
+// Parameters:
+//   - bundle: The directory of the air-gap bundle.
+//   - chart: The path of the chart archive in the bundle.
+//
+// Returns:
+//   - []string: The image references.
+//   - error: An error if the bundle holds no list for the chart.
+func chartImages(bundle, chart string) ([]string, error) {
+	data, err := os.ReadFile(filepath.Join(bundle, filepath.FromSlash(chartImagesFile(chart))))
+	if err != nil {
+		return nil, fmt.Errorf("airgap bundle %s has no %s; run k3sd bundle to build it", bundle, chartImagesFile(chart))
+	}
+	return strings.Fields(string(data)), nil
+}
+
+// requireBundleImages checks that the air-gap bundle holds the tarball of every image an addon runs,
+// if k3sd runs air-gapped.
+//
+// Parameters:
+//   - cluster: The cluster the addon is enabled on.
+//   - addon: The addon.
+//
+// Returns:
+//   - error: An error naming the missing images, or nil.
+func requireBundleImages(cluster Cluster, addon imageBundler) error {
+	if !airgapped() {
+		return nil
+	}
+	images, err := addon.bundleImages(cluster, utils.AirgapBundle)
+	if err != nil {
+		return err
+	}
+	var missing []string
+	for _, image := range images {
+		ref, err := parseImageRef(image)
+		if err != nil {
+			return err
+		}
+		if _, err := os.Stat(filepath.Join(utils.AirgapBundle, filepath.FromSlash(ref.file()))); err != nil && !slices.Contains(missing, ref.String()) {
+			missing = append(missing, ref.String())
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("airgap bundle %s has no image %s; run k3sd bundle to build it", utils.AirgapBundle, strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// localHelm returns a helm binary that runs on this machine: the one on PATH or, if there is
+// none, a release downloaded into a directory.
+//
+// Parameters:
+//   - tmp: The directory a downloaded binary is written to.
+//
+// Returns:
+//   - string: The path of the binary.
+//   - error: An error if there is no helm on PATH and the download fails.
+func localHelm(tmp string) (string, error) {
+	if helm, err := exec.LookPath("helm"); err == nil {
+		return helm, nil
+	}
+	platform := runtime.GOOS + "-" + runtime.GOARCH
+	helm := filepath.Join(tmp, "helm")
+	return helm, downloadHelm(fmt.Sprintf("https://get.helm.sh/helm-%s-%s.tar.gz", defaultHelmVersion, platform), platform+"/helm", helm)
+}
+
+// pullChart downloads a chart with helm pull, from its repository, an OCI registry or a URL.
+//
+// Parameters:
+//   - helm: The path of the local helm binary.
+//   - chart: The chart.
+//   - dest: The path the chart archive is written to.
+//
+// Returns:
+//   - error: An error if helm fails to pull the chart.
+func pullChart(helm string, chart HelmChart, dest string) error {
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+	pulled, err := os.MkdirTemp(filepath.Dir(dest), ".pull")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(pulled)
+	args := []string{"pull", chart.Chart, "--destination", pulled}
+	if chart.Repo != "" {
+		args = append(args, "--repo", chart.Repo)
+	}
+	if chart.Version != "" {
+		args = append(args, "--version", chart.Version)
+	}
+	if out, err := exec.Command(helm, args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("helm pull %s: %v: %s", chart.Chart, err, out)
+	}
+	archives, _ := filepath.Glob(filepath.Join(pulled, "*.tgz"))
+	if len(archives) != 1 {
+		return fmt.Errorf("helm pull %s: want one chart archive, got %d", chart.Chart, len(archives))
+	}
+	return os.Rename(archives[0], dest)
+}
+
+// renderChartImages renders a bundled chart with helm template and writes the images it runs next to it.
+//
+// Parameters:
+//   - helm: The path of the local helm binary.
+//   - tmp: A directory the chart's values are written to.
+//   - dir: The directory of the bundle.
+//   - chart: The chart.
+//
+// Returns:
+//   - error: An error if the chart fails to render or the list cannot be written.
+func renderChartImages(helm, tmp, dir string, chart bundledChart) error {
+	args := []string{"template", chart.release, filepath.Join(dir, filepath.FromSlash(chart.file)), "--namespace", chart.namespace}
+	if chart.values != nil {
+		values := filepath.Join(tmp, chart.release+"-values.yaml")
+		if err := os.WriteFile(values, chart.values, 0600); err != nil {
+			return err
+		}
+		args = append(args, "-f", values)
+	}
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(helm, args...)
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("helm template %s: %v: %s", chart.file, err, stderr.String())
+	}
+	images, err := imageRefs(stdout.Bytes())
+	if err != nil {
+		return fmt.Errorf("helm template %s: %w", chart.file, err)
+	}
+	slices.Sort(images)
+	images = slices.Compact(images)
+	return os.WriteFile(filepath.Join(dir, filepath.FromSlash(chartImagesFile(chart.file))), []byte(strings.Join(images, "\n")+"\n"), 0644)
+}
+
+// bundleClient is the HTTP client used to build air-gap bundles.
+var bundleClient = &http.Client{Timeout: 30 * time.Minute}
+
+// k3sReleaseURL returns the download URL of a k3s release asset.
+func k3sReleaseURL(version, asset string) string {
+	return fmt.Sprintf("https://github.com/k3s-io/k3s/releases/download/%s/%s", strings.ReplaceAll(version, "+", "%2B"), asset)
+}
+
+// bundleK3sVersion picks the k3s release to bundle for clusters: the version or channel they all pin,
+// or the latest release of the stable channel if none pins one.
+//
+// Parameters:
+//   - clusters: The clusters the bundle is built for.
+//
+// Returns:
+//   - string: The version, e.g. v1.32.3+k3s1.
+//   - error: An error if the clusters pin different versions or channels, or a channel cannot be resolved.
+func bundleK3sVersion(clusters []Cluster) (string, error) {
+	pins := map[string]bool{}
+	for _, cluster := range clusters {
+		switch {
+		case cluster.K3sVersion != "":
+			pins[cluster.K3sVersion] = true
+		case cluster.K3sChannel != "":
+			pins["channel "+cluster.K3sChannel] = true
+		}
+	}
+	if len(pins) > 1 {
+		return "", errors.New("the clusters pin different k3s versions or channels; build one bundle per version with --k3s-version")
+	}
+	channel := "stable"
+	for pin := range pins {
+		name, ok := strings.CutPrefix(pin, "channel ")
+		if !ok {
+			return pin, nil
+		}
+		channel = name
+	}
+	return channelK3sVersion(channel)
+}
+
+// channelK3sVersion resolves the latest k3s release of a channel.
+//
+// Parameters:
+//   - channel: The channel, e.g. stable or v1.31.
+//
+// Returns:
+//   - string: The version, e.g. v1.32.3+k3s1.
+//   - error: An error if the channel server cannot be reached.
+func channelK3sVersion(channel string) (string, error) {
+	resp, err := bundleClient.Get("https://update.k3s.io/v1-release/channels/" + channel)
+	if err != nil {
+		return "", fmt.Errorf("resolve k3s %s channel: %w", channel, err)
+	}
+	defer resp.Body.Close()
+	// The channel server redirects to the release page, whose last path element is the version.
+	version := path.Base(resp.Request.URL.Path)
+	if !strings.HasPrefix(version, "v") {
+		return "", fmt.Errorf("resolve k3s %s channel: unexpected release URL %s", channel, resp.Request.URL)
+	}
+	return version, nil
+}
+
+// openDownload starts downloading a URL.
+//
+// Parameters:
+//   - url: The URL.
+//
+// Returns:
+//   - io.ReadCloser: The response body.
+//   - error: An error if the request fails or does not return 200 OK.
+func openDownload(url string) (io.ReadCloser, error) {
+	resp, err := bundleClient.Get(url)
+	if err != nil {
+		return nil, fmt.Errorf("download %s: %w", url, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("download %s: %s", url, resp.Status)
+	}
+	return resp.Body, nil
+}
+
+// download saves a URL to a file, replacing it only once the download completes.
+//
+// Parameters:
+//   - url: The URL.
+//   - dest: The path of the file; its directory is created if missing.
+//
+// Returns:
+//   - error: An error if the download or the write fails.
+func download(url, dest string) error {
+	body, err := openDownload(url)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	return writeDownload(body, dest, url)
+}
+
+// downloadHelm downloads a helm release archive and extracts the helm binary from it.
+//
+// Parameters:
+//   - url: The URL of the .tar.gz release archive.
+//   - member: The path of the binary in the archive.
+//   - dest: The path the binary is written to.
+//
+// Returns:
+//   - error: An error if the download fails or the archive holds no such binary.
+func downloadHelm(url, member, dest string) error {
+	body, err := openDownload(url)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	gz, err := gzip.NewReader(body)
+	if err != nil {
+		return fmt.Errorf("download %s: %w", url, err)
+	}
+	archive := tar.NewReader(gz)
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			return fmt.Errorf("download %s: no %s in the archive", url, member)
+		}
+		if err != nil {
+			return fmt.Errorf("download %s: %w", url, err)
+		}
+		if header.Name == member {
+			return writeDownload(archive, dest, url)
+		}
+	}
+}
+
+// writeDownload writes a download to a temporary file and renames it over the destination.
+func writeDownload(r io.Reader, dest, url string) error {
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+	tmp := dest + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0755)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(file, r); err != nil {
+		file.Close()
+		os.Remove(tmp)
+		return fmt.Errorf("download %s: %w", url, err)
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, dest)
+}
@@ -0,0 +1,194 @@
+package cluster
+
+import (
+	"github.com/argon-chat/k3sd/utils"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// newTestLogger returns a logger whose messages are discarded.
+func newTestLogger() *utils.Logger {
+	logger := utils.NewLogger("test")
+	drain := func(messages <-chan string) {
+		for range messages {
+		}
+	}
+	go drain(logger.Stdout)
+	go drain(logger.Stderr)
+	go drain(logger.Cmd)
+	go func() {
+		for range logger.File {
+		}
+	}()
+	return logger
+}
+
+// hostRouter sends every request of bundleClient to a test server, keeping the host it was meant
+// for in the Host header, so that one handler stands in for every site a bundle is downloaded from.
+type hostRouter struct {
+	server    string            // Host of the test server.
+	transport http.RoundTripper // Transport trusting the test server.
+}
+
+// RoundTrip rewrites the request to the test server.
+func (r hostRouter) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Host = req.URL.Host
+	req.URL.Host = r.server
+	return r.transport.RoundTrip(req)
+}
+
+// writeBundle creates an air-gap bundle holding the given files and selects it for the test.
+func writeBundle(t *testing.T, files ...string) {
+	t.Helper()
+	dir := t.TempDir()
+	for _, rel := range files {
+		file := filepath.Join(dir, filepath.FromSlash(rel))
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(file, []byte(rel), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	previous := utils.AirgapBundle
+	utils.AirgapBundle = dir
+	t.Cleanup(func() { utils.AirgapBundle = previous })
+}
+
+func TestAirgapStep(t *testing.T) {
+	writeBundle(t,
+		"install.sh", "k3s", "helm",
+		"images/k3s-airgap-images-amd64.tar.zst",
+		"images/docker.io_library_postgres_17-alpine.tar",
+		"charts/kube-prometheus-stack-35.5.1.tgz",
+		"charts/kube-prometheus-stack-35.5.1.images",
+		"manifests/cert-manager/v1.17.2/cert-manager.yaml",
+	)
+	nodeFiles := []string{"images/docker.io_library_postgres_17-alpine.tar", "images/k3s-airgap-images-amd64.tar.zst", "install.sh", "k3s"}
+	nodeCommands := []string{
+		"sudo install -m 0755 /tmp/k3sd/airgap/k3s /usr/local/bin/k3s",
+		"sudo mkdir -p /var/lib/rancher/k3s/agent/images && sudo cp /tmp/k3sd/airgap/images/* /var/lib/rancher/k3s/agent/images/",
+	}
+
+	tests := []struct {
+		name     string
+		server   bool
+		files    []string
+		commands []string
+	}{
+		{"agent", false, nodeFiles, nodeCommands},
+		{
+			"server",
+			true,
+			append(slices.Clone(nodeFiles), "charts/kube-prometheus-stack-35.5.1.images", "charts/kube-prometheus-stack-35.5.1.tgz", "helm", "manifests/cert-manager/v1.17.2/cert-manager.yaml"),
+			append(slices.Clone(nodeCommands), "sudo install -m 0755 /tmp/k3sd/airgap/helm /usr/local/bin/helm"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			executor := NewFakeExecutor("10.0.0.1")
+			if err := airgapStep(executor, tt.server).run(); err != nil {
+				t.Fatalf("airgap-bundle: %v", err)
+			}
+			var uploads []string
+			for remote, content := range executor.Uploads {
+				rel, ok := strings.CutPrefix(remote, airgapDir+"/")
+				if !ok || string(content) != rel {
+					t.Errorf("upload %s holds %q", remote, content)
+				}
+				uploads = append(uploads, rel)
+			}
+			slices.Sort(uploads)
+			slices.Sort(tt.files)
+			if !reflect.DeepEqual(uploads, tt.files) {
+				t.Errorf("uploads = %q, want %q", uploads, tt.files)
+			}
+			if !reflect.DeepEqual(executor.Commands, tt.commands) {
+				t.Errorf("commands = %q, want %q", executor.Commands, tt.commands)
+			}
+		})
+	}
+}
+
+func TestBuildAirgapBundle(t *testing.T) {
+	registry := newFakeRegistry()
+	registry.addImage("jetstack/cert-manager-controller", "v1.17.2", "linux/amd64", "linux/arm64")
+	registry.addImage("jetstack/cert-manager-acmesolver", "v1.17.2", "linux/amd64", "linux/arm64")
+	certManager := `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: cert-manager
+spec:
+  template:
+    spec:
+      containers:
+        - name: cert-manager-controller
+          image: "quay.io/jetstack/cert-manager-controller:v1.17.2"
+          args:
+            - --v=2
+            - --acme-http01-solver-image=quay.io/jetstack/cert-manager-acmesolver:v1.17.2
+`
+	downloads := map[string]string{
+		"get.k3s.io/": "#!/bin/sh\n",
+		"github.com/k3s-io/k3s/releases/download/v1.32.3+k3s1/k3s":                              "k3s binary",
+		"github.com/k3s-io/k3s/releases/download/v1.32.3+k3s1/k3s-airgap-images-amd64.tar.zst":  "k3s images",
+		"github.com/cert-manager/cert-manager/releases/download/v1.17.2/cert-manager.crds.yaml": "kind: CustomResourceDefinition\n",
+		"github.com/cert-manager/cert-manager/releases/download/v1.17.2/cert-manager.yaml":      certManager,
+	}
+	host := serveRegistry(t, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Host == "quay.io" {
+			registry.ServeHTTP(w, req)
+			return
+		}
+		content, ok := downloads[req.Host+req.URL.Path]
+		if !ok {
+			http.NotFound(w, req)
+			return
+		}
+		_, _ = w.Write([]byte(content))
+	}))
+	bundleClient = &http.Client{Transport: hostRouter{server: host, transport: bundleClient.Transport}}
+
+	enabled := true
+	cluster := Cluster{Addons: map[string]AddonConfig{AddonCertManager: {Enabled: &enabled}}}
+	cluster.NodeName = "master"
+	dir := t.TempDir()
+	if err := BuildAirgapBundle(dir, "v1.32.3+k3s1", "amd64", []Cluster{cluster}, newTestLogger()); err != nil {
+		t.Fatalf("BuildAirgapBundle: %v", err)
+	}
+
+	files, err := bundleFiles(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"images/k3s-airgap-images-amd64.tar.zst",
+		"images/quay.io_jetstack_cert-manager-acmesolver_v1.17.2.tar",
+		"images/quay.io_jetstack_cert-manager-controller_v1.17.2.tar",
+		"install.sh",
+		"k3s",
+		"k3s-version",
+		"manifests/cert-manager/v1.17.2/cert-manager.crds.yaml",
+		"manifests/cert-manager/v1.17.2/cert-manager.yaml",
+	}
+	if !reflect.DeepEqual(files, want) {
+		t.Errorf("bundle = %q, want %q", files, want)
+	}
+	if content, _ := os.ReadFile(filepath.Join(dir, "k3s")); string(content) != "k3s binary" {
+		t.Errorf("k3s = %q, want the downloaded binary", content)
+	}
+	if content, _ := os.ReadFile(filepath.Join(dir, "k3s-version")); string(content) != "v1.32.3+k3s1\n" {
+		t.Errorf("k3s-version = %q, want v1.32.3+k3s1", content)
+	}
+	layout := readLayout(t, filepath.Join(dir, "images/quay.io_jetstack_cert-manager-controller_v1.17.2.tar"))
+	layer, _ := strings.CutPrefix(registry.layer("linux/amd64"), "sha256:")
+	if string(layout["blobs/sha256/"+layer]) != "linux/amd64" {
+		t.Errorf("the controller image holds no linux/amd64 layer")
+	}
+}
@@ -0,0 +1,113 @@
+package cluster
+
+import (
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// authMethods builds the list of SSH authentication methods for a host.
+//
+// Methods are offered in a fixed order of precedence:
+//   - The private key at KeyPath, decrypted with KeyPassphrase if it is set.
+//   - The signers of the ssh-agent, if one is connected.
+//   - The plaintext Password, if it is set.
+//
+// Parameters:
+//   - host: The Host object holding the credentials.
+//   - keyring: The ssh-agent client opened by dialAgent, or nil if there is no agent.
+//
+// Returns:
+//   - []ssh.AuthMethod: The authentication methods in order of precedence.
+//   - error: An error if the key cannot be loaded or no method is available.
+func authMethods(host Host, keyring agent.Agent) ([]ssh.AuthMethod, error) {
+	var methods []ssh.AuthMethod
+
+	if host.KeyPath != "" {
+		signer, err := loadPrivateKey(host.KeyPath, host.KeyPassphrase)
+		if err != nil {
+			return nil, err
+		}
+		methods = append(methods, ssh.PublicKeys(signer))
+	}
+
+	if keyring != nil {
+		methods = append(methods, ssh.PublicKeysCallback(keyring.Signers))
+	}
+
+	if host.Password != "" {
+		methods = append(methods, ssh.Password(host.Password))
+	}
+
+	if len(methods) == 0 {
+		return nil, errors.New("no keyPath, ssh-agent or password available")
+	}
+	return methods, nil
+}
+
+// dialAgent connects to the ssh-agent listening on SSH_AUTH_SOCK. The caller closes the connection.
+//
+// Returns:
+//   - net.Conn: The connection to the agent, or nil if SSH_AUTH_SOCK is unset or cannot be dialed.
+func dialAgent() net.Conn {
+	sock := os.Getenv("SSH_AUTH_SOCK")
+	if sock == "" {
+		return nil
+	}
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		return nil
+	}
+	return conn
+}
+
+// loadPrivateKey reads and parses a PEM-encoded private key.
+//
+// Parameters:
+//   - keyPath: The path to the private key file; a leading "~/" is expanded to the home directory.
+//   - passphrase: The passphrase protecting the key, or an empty string if it is unencrypted.
+//
+// Returns:
+//   - ssh.Signer: The signer for the parsed key.
+//   - error: An error if the file cannot be read or the key cannot be parsed.
+func loadPrivateKey(keyPath, passphrase string) (ssh.Signer, error) {
+	keyPath = expandHome(keyPath)
+	pem, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("read private key: %w", err)
+	}
+
+	var signer ssh.Signer
+	if passphrase != "" {
+		signer, err = ssh.ParsePrivateKeyWithPassphrase(pem, []byte(passphrase))
+	} else {
+		signer, err = ssh.ParsePrivateKey(pem)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parse private key %s: %w", keyPath, err)
+	}
+	return signer, nil
+}
+
+// expandHome replaces a leading "~/" in a path with the current user's home directory.
+//
+// Parameters:
+//   - p: The path to expand.
+//
+// Returns:
+//   - string: The expanded path, or p unchanged if it does not start with "~/".
+func expandHome(p string) string {
+	if !strings.HasPrefix(p, "~/") {
+		return p
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return p
+	}
+	return filepath.Join(home, p[2:])
+}
@@ -0,0 +1,578 @@
+package cluster
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/santhosh-tekuri/jsonschema/v6"
+	"golang.org/x/text/language"
+	"golang.org/x/text/message"
+	"gopkg.in/yaml.v3"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Schema is the published JSON Schema every cluster config is validated against.
+//
+//go:embed clusters.schema.json
+var Schema []byte
+
+// hostnamePattern matches RFC 1123 hostnames.
+var hostnamePattern = regexp.MustCompile(`^([a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?)(\.[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?)*$`)
+
+// ConfigError is a problem found in a cluster config, located by file, line and column.
+type ConfigError struct {
+	File    string `json:"file"`              // Path of the config file.
+	Line    int    `json:"line,omitempty"`    // 1-based line of the offending value, or 0 if unknown.
+	Column  int    `json:"column,omitempty"`  // 1-based column of the offending value, or 0 if unknown.
+	Pointer string `json:"pointer,omitempty"` // JSON pointer to the offending value, or empty if unknown.
+	Message string `json:"message"`           // Description of the problem.
+}
+
+// Error formats the error as file:line:column: pointer: message.
+func (e ConfigError) Error() string {
+	msg := e.Message
+	if e.Pointer != "" {
+		msg = fmt.Sprintf("%s: %s", e.Pointer, msg)
+	}
+	if e.Line == 0 {
+		return fmt.Sprintf("%s: %s", e.File, msg)
+	}
+	return fmt.Sprintf("%s:%d:%d: %s", e.File, e.Line, e.Column, msg)
+}
+
+// locatedError creates a ConfigError for the value at a JSON pointer.
+//
+// Parameters:
+//   - path: The path of the config.
+//   - root: The root node of the config, or nil if positions are unknown.
+//   - pointer: A JSON pointer to the offending value.
+//   - format: The format string of the message.
+//   - args: The arguments of the message.
+//
+// Returns:
+//   - ConfigError: The error, positioned at the value or its closest existing ancestor.
+func locatedError(path string, root *yaml.Node, pointer string, format string, args ...any) ConfigError {
+	err := ConfigError{File: path, Pointer: displayPointer(pointer), Message: fmt.Sprintf(format, args...)}
+	if root != nil {
+		node := nodeAt(root, pointer)
+		err.Line, err.Column = node.Line, node.Column
+	}
+	return err
+}
+
+// ConfigErrors is every problem found in a cluster config.
+type ConfigErrors []ConfigError
+
+// Error lists every problem, one per line.
+func (e ConfigErrors) Error() string {
+	lines := make([]string, len(e))
+	for i, err := range e {
+		lines[i] = err.Error()
+	}
+	return strings.Join(lines, "\n")
+}
+
+// decodeConfig parses a cluster config, validates it, decodes it into a slice of Cluster objects,
+// and checks the syntax of its secret references, which ResolveSecrets resolves later. Every stage runs as long as the config decodes, so that the
+// problems of all of them are reported together.
+//
+// The format is chosen by extension, ignoring a trailing .age: .yaml and .yml are YAML, .jsonc is
+// JSON with // and /* */ comments, and anything else is strict JSON. The config is either a list of
+// clusters or a mapping with a "clusters" list, the form SOPS requires. Files encrypted with age
+// and SOPS-encrypted documents are decrypted with the identities in K3SD_AGE_KEY_FILE.
+//
+// Parameters:
+//   - path: The path of the config, used to pick the format and in error positions.
+//   - data: The content of the config.
+//
+// Returns:
+//   - []Cluster: The decoded clusters, or nil if the config cannot be parsed or decoded.
+//   - error: A ConfigErrors listing every syntax, schema and consistency problem, which the clusters
+//     are returned along with if they could be decoded.
+func decodeConfig(path string, data []byte) ([]Cluster, error) {
+	root, err := parseConfig(path, data)
+	if err != nil {
+		return nil, err
+	}
+
+	var generic any
+	if err := root.Decode(&generic); err != nil {
+		return nil, ConfigErrors{{File: path, Message: err.Error()}}
+	}
+	doc, err := json.Marshal(generic)
+	if err != nil {
+		return nil, ConfigErrors{{File: path, Message: err.Error()}}
+	}
+
+	errs := validateSchema(path, root, doc)
+
+	var config struct {
+		Clusters []Cluster `json:"clusters"`
+	}
+	if root.Kind == yaml.MappingNode {
+		err = json.Unmarshal(doc, &config)
+	} else {
+		err = json.Unmarshal(doc, &config.Clusters)
+	}
+	if err != nil {
+		// A value of the wrong type is already reported by the schema.
+		if len(errs) == 0 {
+			errs = ConfigErrors{{File: path, Message: err.Error()}}
+		}
+		return nil, errs
+	}
+	clusters := config.Clusters
+	errs = append(errs, validateNodeNames(path, root, clusters)...)
+	errs = append(errs, mergeAddonSettings(path, root, clusters)...)
+	errs = append(errs, checkSecretRefs(path, root, clusters)...)
+	resolveAddonPaths(path, clusters)
+	resolveDatastorePaths(path, clusters)
+	if len(errs) > 0 {
+		return clusters, errs
+	}
+	return clusters, nil
+}
+
+// configRoot reads and parses a config again for the positions of its values.
+//
+// Parameters:
+//   - path: The path of the config.
+//
+// Returns:
+//   - *yaml.Node: The root value of the document, or nil if the config cannot be read or parsed.
+func configRoot(path string) *yaml.Node {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	root, err := parseConfig(path, data)
+	if err != nil {
+		return nil
+	}
+	return root
+}
+
+// parseConfig decrypts and parses a config into a YAML node tree, which keeps the position of every value.
+//
+// Parameters:
+//   - path: The path of the config.
+//   - data: The content of the config.
+//
+// Returns:
+//   - *yaml.Node: The root value of the document.
+//   - error: A ConfigErrors describing the syntax or decryption error.
+func parseConfig(path string, data []byte) (*yaml.Node, error) {
+	if isAgeEncrypted(data) {
+		plaintext, err := decryptAge(data)
+		if err != nil {
+			return nil, ConfigErrors{{File: path, Message: err.Error()}}
+		}
+		data = plaintext
+	}
+	root, err := parseDocument(path, data)
+	if err != nil {
+		return nil, err
+	}
+	return decryptedRoot(path, root)
+}
+
+// parseDocument parses a plaintext config into a YAML node tree in the format its extension names,
+// leaving any SOPS-encrypted values and metadata as they are.
+//
+// Parameters:
+//   - path: The path of the config, whose extension picks the format.
+//   - data: The content of the config, decrypted if it was encrypted with age.
+//
+// Returns:
+//   - *yaml.Node: The root value of the document.
+//   - error: A ConfigErrors describing the syntax error.
+func parseDocument(path string, data []byte) (*yaml.Node, error) {
+	switch ext := strings.ToLower(filepath.Ext(strings.TrimSuffix(path, ".age"))); ext {
+	case ".yaml", ".yml":
+	case ".jsonc":
+		data = stripJSONComments(data)
+		fallthrough
+	default:
+		var v any
+		if err := json.Unmarshal(data, &v); err != nil {
+			configErr := ConfigError{File: path, Message: err.Error()}
+			var syntaxErr *json.SyntaxError
+			if errors.As(err, &syntaxErr) {
+				configErr.Line, configErr.Column = offsetPosition(data, syntaxErr.Offset)
+				if bytes.Contains(data, []byte("//")) && ext == ".json" {
+					configErr.Message += " (use the .jsonc extension for a config with comments)"
+				}
+			}
+			return nil, ConfigErrors{configErr}
+		}
+		// JSON is not parsed as YAML, which rejects some of its escapes, such as \/.
+		root, err := jsonNode(data)
+		if err != nil {
+			return nil, ConfigErrors{{File: path, Message: err.Error()}}
+		}
+		return root, nil
+	}
+
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, ConfigErrors{{File: path, Message: err.Error()}}
+	}
+	if len(doc.Content) == 0 {
+		return nil, ConfigErrors{{File: path, Message: "config is empty"}}
+	}
+	return doc.Content[0], nil
+}
+
+// decryptedRoot decrypts the SOPS-encrypted values of a parsed config in place.
+//
+// Parameters:
+//   - path: The path of the config.
+//   - root: The root value of the document.
+//
+// Returns:
+//   - *yaml.Node: The root value, decrypted.
+//   - error: A ConfigErrors describing the decryption error.
+func decryptedRoot(path string, root *yaml.Node) (*yaml.Node, error) {
+	if err := decryptSOPS(root); err != nil {
+		return nil, ConfigErrors{{File: path, Message: err.Error()}}
+	}
+	return root, nil
+}
+
+// jsonNode builds a YAML node tree from a JSON document with the JSON decoder, so that every value
+// keeps its position for error messages and is decoded with JSON's own rules.
+//
+// Parameters:
+//   - data: A valid JSON document.
+//
+// Returns:
+//   - *yaml.Node: The root value of the document.
+//   - error: An error if the document is not valid JSON.
+func jsonNode(data []byte) (*yaml.Node, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	root, err := decodeJSONNode(decoder, data)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return nil, errors.New("unexpected data after the top-level value")
+	}
+	return root, nil
+}
+
+// decodeJSONNode reads the next JSON value from a decoder as a YAML node.
+//
+// Parameters:
+//   - decoder: The decoder, with UseNumber set.
+//   - data: The document being decoded, used to compute positions.
+//
+// Returns:
+//   - *yaml.Node: The value.
+//   - error: An error if the value is not valid JSON.
+func decodeJSONNode(decoder *json.Decoder, data []byte) (*yaml.Node, error) {
+	// The decoder's offset is the end of the previous token; the value starts after any separators.
+	start := decoder.InputOffset()
+	for start < int64(len(data)) && strings.IndexByte(" \t\r\n,:", data[start]) >= 0 {
+		start++
+	}
+	token, err := decoder.Token()
+	if err != nil {
+		return nil, err
+	}
+	node := &yaml.Node{}
+	node.Line, node.Column = offsetPosition(data, start)
+	switch value := token.(type) {
+	case json.Delim:
+		node.Kind, node.Tag = yaml.SequenceNode, "!!seq"
+		if value == '{' {
+			node.Kind, node.Tag = yaml.MappingNode, "!!map"
+		}
+		for decoder.More() {
+			child, err := decodeJSONNode(decoder, data)
+			if err != nil {
+				return nil, err
+			}
+			node.Content = append(node.Content, child)
+			if node.Kind == yaml.MappingNode {
+				if child, err = decodeJSONNode(decoder, data); err != nil {
+					return nil, err
+				}
+				node.Content = append(node.Content, child)
+			}
+		}
+		// Consume the closing delimiter.
+		if _, err := decoder.Token(); err != nil {
+			return nil, err
+		}
+	case string:
+		node.Kind, node.Tag, node.Value, node.Style = yaml.ScalarNode, "!!str", value, yaml.DoubleQuotedStyle
+	case json.Number:
+		node.Kind, node.Tag, node.Value = yaml.ScalarNode, "!!int", value.String()
+		if strings.ContainsAny(node.Value, ".eE") {
+			node.Tag = "!!float"
+		}
+	case bool:
+		node.Kind, node.Tag, node.Value = yaml.ScalarNode, "!!bool", strconv.FormatBool(value)
+	case nil:
+		node.Kind, node.Tag, node.Value = yaml.ScalarNode, "!!null", "null"
+	}
+	return node, nil
+}
+
+// clustersPointer returns the JSON pointer of the list of clusters in a config.
+//
+// Parameters:
+//   - root: The root node of the config, or nil if unknown.
+//
+// Returns:
+//   - string: "/clusters" for a mapping config, or the empty pointer for a list.
+func clustersPointer(root *yaml.Node) string {
+	if root != nil && root.Kind == yaml.MappingNode {
+		return "/clusters"
+	}
+	return ""
+}
+
+// validateSchema validates a config against Schema.
+//
+// Parameters:
+//   - path: The path of the config.
+//   - root: The root node of the config, used to locate errors.
+//   - doc: The config as JSON.
+//
+// Returns:
+//   - ConfigErrors: Every schema violation, or nil if the config is valid.
+func validateSchema(path string, root *yaml.Node, doc []byte) ConfigErrors {
+	schema, err := compileSchema()
+	if err != nil {
+		return ConfigErrors{{File: path, Message: fmt.Sprintf("compile schema: %v", err)}}
+	}
+	instance, err := jsonschema.UnmarshalJSON(bytes.NewReader(doc))
+	if err != nil {
+		return ConfigErrors{{File: path, Message: err.Error()}}
+	}
+
+	var validationErr *jsonschema.ValidationError
+	if err := schema.Validate(instance); !errors.As(err, &validationErr) {
+		return nil
+	}
+
+	var errs ConfigErrors
+	printer := message.NewPrinter(language.English)
+	var collect func(e *jsonschema.ValidationError)
+	collect = func(e *jsonschema.ValidationError) {
+		if len(e.Causes) > 0 {
+			for _, cause := range e.Causes {
+				collect(cause)
+			}
+			return
+		}
+		errs = append(errs, locatedError(path, root, toPointer(e.InstanceLocation), "%s", e.ErrorKind.LocalizedString(printer)))
+	}
+	collect(validationErr)
+	sort.SliceStable(errs, func(i, j int) bool {
+		if errs[i].Line != errs[j].Line {
+			return errs[i].Line < errs[j].Line
+		}
+		return errs[i].Column < errs[j].Column
+	})
+	return errs
+}
+
+// compileSchema compiles Schema, registering the custom "host" format for node addresses.
+//
+// Returns:
+//   - *jsonschema.Schema: The compiled schema.
+//   - error: An error if the schema is invalid.
+func compileSchema() (*jsonschema.Schema, error) {
+	doc, err := jsonschema.UnmarshalJSON(bytes.NewReader(Schema))
+	if err != nil {
+		return nil, err
+	}
+	compiler := jsonschema.NewCompiler()
+	compiler.AssertFormat()
+	compiler.RegisterFormat(&jsonschema.Format{Name: "host", Validate: validateHost})
+	if err := compiler.AddResource("clusters.schema.json", doc); err != nil {
+		return nil, err
+	}
+	return compiler.Compile("clusters.schema.json")
+}
+
+// validateHost checks that a value is an IP address or an RFC 1123 hostname.
+//
+// Parameters:
+//   - v: The value to check; non-strings are accepted and left to the type check.
+//
+// Returns:
+//   - error: An error if the value is a string but neither an IP address nor a hostname.
+func validateHost(v any) error {
+	s, ok := v.(string)
+	if !ok {
+		return nil
+	}
+	if net.ParseIP(s) != nil || (len(s) <= 253 && hostnamePattern.MatchString(s)) {
+		return nil
+	}
+	return fmt.Errorf("%q is neither an IP address nor a hostname", s)
+}
+
+// validateNodeNames checks that every node name is unique across all clusters.
+//
+// Parameters:
+//   - path: The path of the config.
+//   - root: The root node of the config, used to locate errors.
+//   - clusters: The decoded clusters.
+//
+// Returns:
+//   - ConfigErrors: An error for every repeated node name, or nil if all are unique.
+func validateNodeNames(path string, root *yaml.Node, clusters []Cluster) ConfigErrors {
+	var errs ConfigErrors
+	seen := map[string]string{}
+	check := func(name, pointer string) {
+		if first, ok := seen[name]; ok {
+			errs = append(errs, locatedError(path, root, pointer, "duplicate nodeName %q, already used at %s", name, displayPointer(first)))
+			return
+		}
+		seen[name] = pointer
+	}
+	prefix := clustersPointer(root)
+	for ci, cluster := range clusters {
+		check(cluster.NodeName, fmt.Sprintf("%s/%d/nodeName", prefix, ci))
+		for wi, worker := range cluster.Workers {
+			check(worker.NodeName, fmt.Sprintf("%s/%d/workers/%d/nodeName", prefix, ci, wi))
+		}
+		for si, server := range cluster.Servers {
+			check(server.NodeName, fmt.Sprintf("%s/%d/servers/%d/nodeName", prefix, ci, si))
+		}
+	}
+	return errs
+}
+
+// nodeAt returns the deepest node of the tree that exists along a JSON pointer.
+//
+// Parameters:
+//   - root: The root node.
+//   - pointer: A JSON pointer such as /0/workers/1/address.
+//
+// Returns:
+//   - *yaml.Node: The node at the pointer, or its closest existing ancestor.
+func nodeAt(root *yaml.Node, pointer string) *yaml.Node {
+	node := root
+	for _, token := range strings.Split(strings.TrimPrefix(pointer, "/"), "/") {
+		if token == "" {
+			continue
+		}
+		token = strings.NewReplacer("~1", "/", "~0", "~").Replace(token)
+		next := childNode(node, token)
+		if next == nil {
+			break
+		}
+		node = next
+	}
+	return node
+}
+
+// childNode returns the value of a mapping key or the element of a sequence index.
+func childNode(node *yaml.Node, token string) *yaml.Node {
+	switch node.Kind {
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			if node.Content[i].Value == token {
+				return node.Content[i+1]
+			}
+		}
+	case yaml.SequenceNode:
+		if i, err := strconv.Atoi(token); err == nil && i >= 0 && i < len(node.Content) {
+			return node.Content[i]
+		}
+	}
+	return nil
+}
+
+// toPointer joins path tokens into a JSON pointer.
+func toPointer(tokens []string) string {
+	escaper := strings.NewReplacer("~", "~0", "/", "~1")
+	var sb strings.Builder
+	for _, token := range tokens {
+		sb.WriteString("/")
+		sb.WriteString(escaper.Replace(token))
+	}
+	return sb.String()
+}
+
+// displayPointer renders a JSON pointer for error messages, using "/" for the document root.
+func displayPointer(pointer string) string {
+	if pointer == "" {
+		return "/"
+	}
+	return pointer
+}
+
+// offsetPosition converts a byte offset into a 1-based line and column.
+//
+// Parameters:
+//   - data: The content the offset points into.
+//   - offset: The byte offset.
+//
+// Returns:
+//   - int: The line.
+//   - int: The column.
+func offsetPosition(data []byte, offset int64) (int, int) {
+	offset = min(max(offset, 0), int64(len(data)))
+	before := data[:offset]
+	line := bytes.Count(before, []byte("\n")) + 1
+	column := int(offset) - bytes.LastIndexByte(before, '\n')
+	return line, column
+}
+
+// stripJSONComments blanks out // and /* */ comments outside of strings, keeping every
+// newline so that positions in the result match the original.
+//
+// Parameters:
+//   - data: JSON with comments.
+//
+// Returns:
+//   - []byte: The JSON without comments.
+func stripJSONComments(data []byte) []byte {
+	out := bytes.Clone(data)
+	inString := false
+	for i := 0; i < len(out); i++ {
+		switch {
+		case inString:
+			if out[i] == '\\' {
+				i++
+			} else if out[i] == '"' {
+				inString = false
+			}
+		case out[i] == '"':
+			inString = true
+		case out[i] == '/' && i+1 < len(out) && out[i+1] == '/':
+			for ; i < len(out) && out[i] != '\n'; i++ {
+				out[i] = ' '
+			}
+		case out[i] == '/' && i+1 < len(out) && out[i+1] == '*':
+			end := bytes.Index(out[i+2:], []byte("*/"))
+			stop := len(out)
+			if end >= 0 {
+				stop = i + 2 + end + 2
+			}
+			for ; i < stop; i++ {
+				if out[i] != '\n' {
+					out[i] = ' '
+				}
+			}
+			i--
+		}
+	}
+	return out
+}
@@ -0,0 +1,161 @@
+package cluster
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDecodeConfigJSONEscapes(t *testing.T) {
+	tests := []struct {
+		name     string
+		path     string
+		data     string
+		password string
+	}{
+		{"escaped slash", "clusters.json", `[{"address":"10.0.0.1","user":"root","nodeName":"m","password":"a\/b"}]`, "a/b"},
+		{"unicode escape", "clusters.json", `[{"address":"10.0.0.1","user":"root","nodeName":"m","password":"café"}]`, "café"},
+		{"escaped quote and backslash", "clusters.json", `[{"address":"10.0.0.1","user":"root","nodeName":"m","password":"a\"b\\c"}]`, `a"b\c`},
+		{"tab escape and tab indentation", "clusters.json", "[\n\t{\"address\":\"10.0.0.1\",\"user\":\"root\",\"nodeName\":\"m\",\"password\":\"a\\tb\"}\n]", "a\tb"},
+		{"string that YAML would read as a boolean", "clusters.json", `[{"address":"10.0.0.1","user":"root","nodeName":"m","password":"yes"}]`, "yes"},
+		{"jsonc with comments", "clusters.jsonc", "[{\"address\":\"10.0.0.1\", // master\n\"user\":\"root\",\"nodeName\":\"m\",\"password\":\"a\\/b\"}]", "a/b"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clusters, err := decodeConfig(tt.path, []byte(tt.data))
+			if err != nil {
+				t.Fatalf("decodeConfig: %v", err)
+			}
+			if len(clusters) != 1 {
+				t.Fatalf("got %d clusters, want 1", len(clusters))
+			}
+			if got := clusters[0].Password; got != tt.password {
+				t.Errorf("password = %q, want %q", got, tt.password)
+			}
+		})
+	}
+}
+
+func TestDecodeConfigJSONErrorPosition(t *testing.T) {
+	data := "[\n  {\n    \"address\": \"10.0.0.1\",\n    \"user\": \"r\\/oot\",\n    \"nodeName\": \"m\",\n    \"port\": 0\n  }\n]"
+	_, err := decodeConfig("clusters.json", []byte(data))
+	var errs ConfigErrors
+	if !errors.As(err, &errs) || len(errs) != 1 {
+		t.Fatalf("got %v, want one ConfigError", err)
+	}
+	if got := errs[0]; got.Pointer != "/0/port" || got.Line != 6 || got.Column != 13 {
+		t.Errorf("got %s at %d:%d, want /0/port at 6:13", got.Pointer, got.Line, got.Column)
+	}
+}
+
+func TestCheckClustersReportsEveryProblem(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "clusters.yaml")
+	config := `- address: 10.0.0.1
+  user: root
+  nodeName: master
+  port: 0
+  labels: role
+  addons:
+    gitea: true
+  gitea:
+    pg:
+      user: gitea
+      db: gitea
+  workers:
+    - address: 10.0.0.2
+      user: root
+      nodeName: master
+`
+	if err := os.WriteFile(path, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+	_, errs, err := CheckClusters(path)
+	if err != nil {
+		t.Fatalf("CheckClusters: %v", err)
+	}
+	want := []string{
+		path + ":4:9: /0/port: minimum: got 0, want 1",
+		path + ":15:17: /0/workers/0/nodeName: duplicate nodeName \"master\", already used at /0/nodeName",
+		path + ":1:3: /0: gitea addon: gitea.pg.password is required",
+		path + ":5:11: /0/labels: label \"role\" is not a k=v pair",
+	}
+	var got []string
+	for _, e := range errs {
+		got = append(got, e.Error())
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("problems =\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestGiteaPgUnderAddons(t *testing.T) {
+	tests := []struct {
+		name     string
+		gitea    string // Top-level gitea field of the cluster.
+		problems []string
+	}{
+		{name: "addons only"},
+		{
+			name:  "both places",
+			gitea: "  gitea:\n    pg:\n      user: other\n",
+			problems: []string{
+				":9:9: /0/addons/gitea/pg: gitea.pg is also set at the top level of the cluster; set it in one place",
+				":1:3: /0: gitea addon: gitea.pg.password is required",
+				":1:3: /0: gitea addon: gitea.pg.db is required",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "clusters.yaml")
+			config := `- address: 10.0.0.1
+  user: root
+  nodeName: master
+  addons:
+    gitea:
+      enabled: true
+      version: "1.23"
+      pg:
+        user: gitea
+        password: env:K3SD_TEST_GITEA_PG
+        db: gitea_db
+` + tt.gitea
+			if err := os.WriteFile(path, []byte(config), 0600); err != nil {
+				t.Fatal(err)
+			}
+			clusters, errs, err := CheckClusters(path)
+			if err != nil {
+				t.Fatalf("CheckClusters: %v", err)
+			}
+			var got []string
+			for _, e := range errs {
+				got = append(got, strings.TrimPrefix(e.Error(), path))
+			}
+			if !reflect.DeepEqual(got, tt.problems) {
+				t.Fatalf("problems = %q, want %q", got, tt.problems)
+			}
+			if tt.problems != nil {
+				return
+			}
+			want := Pg{Username: "gitea", Password: "env:K3SD_TEST_GITEA_PG", DbName: "gitea_db"}
+			if got := clusters[0].Gitea.Pg; got != want {
+				t.Errorf("gitea.pg = %+v, want %+v", got, want)
+			}
+
+			err = ResolveSecrets(path, clusters)
+			if err == nil || err.Error() != path+":10:19: /0/addons/gitea/pg/password: environment variable K3SD_TEST_GITEA_PG is not set" {
+				t.Errorf("ResolveSecrets = %v, want the unset variable located under addons.gitea", err)
+			}
+			t.Setenv("K3SD_TEST_GITEA_PG", "pg-secret")
+			if err := ResolveSecrets(path, clusters); err != nil {
+				t.Fatalf("ResolveSecrets: %v", err)
+			}
+			if got := clusters[0].Gitea.Pg.Password; got != "pg-secret" {
+				t.Errorf("gitea.pg.password = %q, want pg-secret", got)
+			}
+		})
+	}
+}
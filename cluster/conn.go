@@ -0,0 +1,286 @@
+package cluster
+
+import (
+	"fmt"
+	"github.com/argon-chat/k3sd/utils"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultPort              = 22
+	defaultConnectTimeout    = 15 * time.Second
+	defaultKeepaliveInterval = 30 * time.Second
+	reconnectAttempts        = 5
+	reconnectBackoff         = 2 * time.Second
+	maxReconnectBackoff      = 30 * time.Second
+)
+
+// Connection is an SSH connection to a node that transparently reconnects
+// when the underlying client breaks between commands.
+type Connection struct {
+	host   *Host         // Host the connection is made to.
+	jump   []Host        // Bastion hosts hopped through, in order.
+	logger *utils.Logger // Logger used to report reconnects.
+
+	agentConn net.Conn    // Connection to the ssh-agent, shared by every hop and reconnect; nil if none.
+	keyring   agent.Agent // Client of the ssh-agent over agentConn; nil if none.
+
+	mu     sync.Mutex
+	client *ssh.Client
+	broken bool
+}
+
+// Connect opens a Connection to a host, hopping through any bastion hosts.
+//
+// Parameters:
+//   - host: A pointer to the Host holding the address, credentials and pinned host key.
+//   - jump: The bastion hosts to hop through, in order, before reaching host.
+//   - logger: A pointer to a utils.Logger instance for logging operations.
+//
+// Returns:
+//   - *Connection: The established connection.
+//   - error: An error if the connection fails.
+func Connect(host *Host, jump []Host, logger *utils.Logger) (*Connection, error) {
+	c := &Connection{host: host, jump: jump, logger: logger}
+	if c.agentConn = dialAgent(); c.agentConn != nil {
+		c.keyring = agent.NewClient(c.agentConn)
+	}
+	client, err := sshConnect(host, jump, c.keyring)
+	if err != nil {
+		c.closeAgent()
+		return nil, err
+	}
+	c.client = client
+	go c.watch(client)
+	return c, nil
+}
+
+// Client returns a live ssh.Client, reconnecting with exponential backoff if the
+// previous client has broken.
+//
+// Returns:
+//   - *ssh.Client: The live client.
+//   - error: An error if every reconnect attempt fails.
+func (c *Connection) Client() (*ssh.Client, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.broken {
+		return c.client, nil
+	}
+
+	backoff := reconnectBackoff
+	var err error
+	for attempt := 1; attempt <= reconnectAttempts; attempt++ {
+		c.logger.LogErr("Connection to %s lost, reconnecting (attempt %d/%d)", c.host.Address, attempt, reconnectAttempts)
+		var client *ssh.Client
+		if client, err = sshConnect(c.host, c.jump, c.keyring); err == nil {
+			c.client = client
+			c.broken = false
+			go c.watch(client)
+			return client, nil
+		}
+		time.Sleep(backoff)
+		backoff = min(backoff*2, maxReconnectBackoff)
+	}
+	return nil, fmt.Errorf("reconnect to %s: %w", c.host.Address, err)
+}
+
+// Close closes the underlying client, any bastion connections and the ssh-agent connection.
+//
+// Returns:
+//   - error: An error if the client cannot be closed.
+func (c *Connection) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closeAgent()
+	return c.client.Close()
+}
+
+// closeAgent closes the ssh-agent connection, if one is open.
+func (c *Connection) closeAgent() {
+	if c.agentConn != nil {
+		_ = c.agentConn.Close()
+		c.agentConn, c.keyring = nil, nil
+	}
+}
+
+// watch marks the connection as broken once the given client disconnects.
+func (c *Connection) watch(client *ssh.Client) {
+	_ = client.Wait()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.client == client {
+		c.broken = true
+	}
+}
+
+// sshConnect establishes an SSH connection to a remote host, hopping through any bastion hosts.
+//
+// Parameters:
+//   - host: A pointer to the Host holding the address, credentials and pinned host key.
+//   - jump: The bastion hosts to hop through, in order, before reaching host.
+//   - keyring: The ssh-agent client offered on every hop, or nil if there is no agent.
+//
+// Returns:
+//   - *ssh.Client: The client. Closing it also closes the bastion connections.
+//   - error: An error if the connection fails.
+func sshConnect(host *Host, jump []Host, keyring agent.Agent) (*ssh.Client, error) {
+	var via *ssh.Client
+	for i := range jump {
+		hop, err := dialHost(via, &jump[i], keyring)
+		if err != nil {
+			if via != nil {
+				_ = via.Close()
+			}
+			return nil, fmt.Errorf("jump host %s: %w", jump[i].Address, err)
+		}
+		closeWith(hop, via)
+		via = hop
+	}
+
+	client, err := dialHost(via, host, keyring)
+	if err != nil {
+		if via != nil {
+			_ = via.Close()
+		}
+		return nil, err
+	}
+	closeWith(client, via)
+	return client, nil
+}
+
+// dialHost opens an SSH connection to a host, either directly or through an existing connection,
+// and starts sending keepalives on it.
+//
+// Parameters:
+//   - via: A pointer to the ssh.Client of the previous hop, or nil to dial directly.
+//   - host: A pointer to the Host to connect to.
+//   - keyring: The ssh-agent client, or nil if there is no agent.
+//
+// Returns:
+//   - *ssh.Client: The client.
+//   - error: An error if the connection or the handshake fails or times out.
+func dialHost(via *ssh.Client, host *Host, keyring agent.Agent) (*ssh.Client, error) {
+	timeout, err := parseDuration(host.ConnectTimeout, defaultConnectTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("connectTimeout for %s: %w", host.Address, err)
+	}
+	keepalive, err := parseDuration(host.KeepaliveInterval, defaultKeepaliveInterval)
+	if err != nil {
+		return nil, fmt.Errorf("keepaliveInterval for %s: %w", host.Address, err)
+	}
+	auth, err := authMethods(*host, keyring)
+	if err != nil {
+		return nil, fmt.Errorf("ssh auth for %s: %w", host.Address, err)
+	}
+	hostKey, err := hostKeyCallback(host)
+	if err != nil {
+		return nil, fmt.Errorf("host key check for %s: %w", host.Address, err)
+	}
+	cfg := &ssh.ClientConfig{
+		User:            host.User,
+		Auth:            auth,
+		HostKeyCallback: hostKey,
+		Timeout:         timeout,
+	}
+
+	addr := host.addr()
+	var conn net.Conn
+	if via == nil {
+		conn, err = net.DialTimeout("tcp", addr, timeout)
+	} else {
+		conn, err = via.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Bound the handshake by the same timeout as the dial.
+	_ = conn.SetDeadline(time.Now().Add(timeout))
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, cfg)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Time{})
+
+	client := ssh.NewClient(c, chans, reqs)
+	go keepAlive(client, keepalive)
+	return client, nil
+}
+
+// keepAlive periodically sends keepalive requests on a client, closing it if the remote
+// stops answering. It returns once the client is closed.
+//
+// Parameters:
+//   - client: A pointer to the ssh.Client to keep alive.
+//   - interval: The time between keepalive requests; zero or negative disables them.
+func keepAlive(client *ssh.Client, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	done := make(chan struct{})
+	go func() {
+		_ = client.Wait()
+		close(done)
+	}()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if _, _, err := client.SendRequest("keepalive@openssh.com", true, nil); err != nil {
+				_ = client.Close()
+				return
+			}
+		}
+	}
+}
+
+// closeWith closes the previous hop once the client tunnelled through it is closed.
+//
+// Parameters:
+//   - client: A pointer to the ssh.Client tunnelled through via.
+//   - via: A pointer to the ssh.Client of the previous hop, or nil.
+func closeWith(client, via *ssh.Client) {
+	if via == nil {
+		return
+	}
+	go func() {
+		_ = client.Wait()
+		_ = via.Close()
+	}()
+}
+
+// addr returns the host's address joined with its SSH port.
+func (h Host) addr() string {
+	port := h.Port
+	if port == 0 {
+		port = defaultPort
+	}
+	return net.JoinHostPort(h.Address, strconv.Itoa(port))
+}
+
+// parseDuration parses a duration string such as "10s", falling back to a default when empty.
+//
+// Parameters:
+//   - value: The duration string to parse.
+//   - fallback: The duration returned when value is empty.
+//
+// Returns:
+//   - time.Duration: The parsed duration.
+//   - error: An error if value is not a valid duration.
+func parseDuration(value string, fallback time.Duration) (time.Duration, error) {
+	if value == "" {
+		return fallback, nil
+	}
+	return time.ParseDuration(value)
+}
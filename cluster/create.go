@@ -1,124 +1,284 @@
 package cluster
 
 import (
-	"bufio"
 	"fmt"
 	"github.com/argon-chat/k3sd/utils"
-	"golang.org/x/crypto/ssh"
-	"io"
-	"log"
 	"os"
 	"os/exec"
 	"path"
 	"strings"
+	"sync"
 )
 
-// CreateCluster sets up a Kubernetes cluster and its workers, installs optional applications,
-// and configures Linkerd if specified.
+// linkerdMu serialises Linkerd installs, which share the root certificates in the kubeconfigs directory.
+var linkerdMu sync.Mutex
+
+// serverInstallEnv holds the install script variables of a cluster's server.
+const serverInstallEnv = `K3S_KUBECONFIG_MODE="644"`
+
+// CreateCluster sets up a Kubernetes cluster and its workers and installs the addons enabled on it.
 //
 // Parameters:
 // - clusters: A slice of Cluster objects representing the clusters to be created.
 // - logger: A pointer to a utils.Logger instance for logging operations.
 // - additional: A slice of additional commands to execute during cluster setup.
+// - save: A SaveFunc called after every completed step and node, so progress survives a failure; may be nil.
 //
 // Returns:
 // - A slice of updated Cluster objects.
 // - An error if any operation fails.
-func CreateCluster(clusters []Cluster, logger *utils.Logger, additional []string) ([]Cluster, error) {
-	for ci, cluster := range clusters {
-		// Establish an SSH connection to the cluster.
-		client, err := sshConnect(cluster.User, cluster.Password, cluster.Address)
+func CreateCluster(clusters []Cluster, logger *utils.Logger, additional []string, save SaveFunc) ([]Cluster, error) {
+	commit := newCheckpoint(clusters, save, logger)
+	err := forEachParallel(len(clusters), utils.Parallel, func(ci int) error {
+		return createCluster(&clusters[ci], logger.WithPrefix(clusters[ci].NodeName), additional, commit)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return clusters, nil
+}
+
+// createCluster sets up a single cluster's master, joins its additional servers one at a time and then
+// its workers in parallel.
+//
+// Parameters:
+// - cluster: A pointer to the Cluster to create; its Done flags and host keys are updated in place.
+// - logger: A pointer to a utils.Logger instance for logging operations.
+// - additional: A slice of additional commands to execute during cluster setup.
+// - commit: The checkpoint used to update and persist the cluster state.
+//
+// Returns:
+// - An error if any operation fails.
+func createCluster(cluster *Cluster, logger *utils.Logger, additional []string, commit checkpoint) error {
+	// Establish an SSH connection to the cluster.
+	client, err := Dial(&cluster.Host, cluster.Jump, logger)
+	if err != nil {
+		return err
+	}
+	defer func(client Executor) {
+		err := client.Close()
+		if err != nil {
+
+		}
+	}(client)
+
+	if !cluster.Done || hasForcedSteps() {
+		addons, err := clusterAddons(*cluster)
 		if err != nil {
-			return nil, err
+			return err
 		}
-		defer func(client *ssh.Client) {
-			err := client.Close()
-			if err != nil {
-
-			}
-		}(client)
-
-		if !cluster.Done {
-			// Prepare and execute commands for setting up the cluster.
-			cmds := append(baseClusterCommands(cluster), additional...)
-			appendOptionalApps(&cmds, cluster.Domain, cluster.Gitea.Pg)
-			logger.Log("Connecting to cluster: %s", cluster.Address)
-			if err := ExecuteCommands(client, cmds, logger); err != nil {
-				return nil, fmt.Errorf("exec master: %v", err)
-			}
-			cl := &clusters[ci]
-			cl.Done = true
-			saveKubeConfig(client, cluster, cl.NodeName, logger)
-
-			// Install Linkerd if specified in the flags.
-			if utils.Flags["linkerd"] {
-				runLinkerdInstall(cluster, logger, false)
-			}
-			if utils.Flags["linkerd-mc"] {
-				runLinkerdInstall(cluster, logger, true)
-			}
+
+		// Prepare and run the checkpointed steps for setting up the cluster.
+		steps := baseClusterSteps(client, *cluster)
+		if len(additional) > 0 {
+			steps = append(steps, commandStep("additional", client, additional...))
 		}
+		logger.Log("Connecting to cluster: %s", cluster.Address)
+		if err := runSteps(&cluster.Worker, steps, logger, commit); err != nil {
+			return fmt.Errorf("exec master: %v", err)
+		}
+		recordK3sVersion(client, &cluster.Worker, logger, commit)
+		kubeconfig, err := saveKubeConfig(client, *cluster, cluster.NodeName, logger)
+		if err != nil {
+			return fmt.Errorf("kubeconfig: %v", err)
+		}
+		commit(func() { cluster.Kubeconfig = kubeconfig })
+
+		// Install the enabled addons, dependencies first, once the kubeconfig is available.
+		env := AddonEnv{Cluster: *cluster, Master: client, Kubeconfig: cluster.Kubeconfig, Logger: logger}
+		if err := runSteps(&cluster.Worker, addonSteps(addons, env), logger, commit); err != nil {
+			return fmt.Errorf("addons: %v", err)
+		}
+		commit(func() { cluster.Done = true })
+	}
 
-		// Configure worker nodes for the cluster.
-		for wi, worker := range cluster.Workers {
-			if worker.Done {
-				continue
-			}
-			cl := &clusters[ci].Workers[wi]
-			cl.Done = true
-
-			// Generate a token for the worker node to join the cluster.
-			token, err := ExecuteRemoteScript(client, "echo $(k3s token create)", logger)
-			if err != nil {
-				logger.Log("token error for %s: %v", cluster.Address, err)
-				continue
-			}
-
-			// Commands to join the worker node to the cluster.
-			joinCmds := []string{
-				fmt.Sprintf("ssh %s@%s \"sudo apt update && sudo apt install -y curl\"", worker.User, worker.Address),
-				fmt.Sprintf("ssh %s@%s \"curl -sfL https://get.k3s.io | K3S_URL=https://%s:6443 K3S_TOKEN='%s' sh -\"", worker.User, worker.Address, cluster.Address, strings.TrimSpace(token)),
-				fmt.Sprintf("kubectl label node %s %s --overwrite", worker.NodeName, worker.Labels),
-			}
-			if err := ExecuteCommands(client, joinCmds, logger); err != nil {
-				return nil, fmt.Errorf("worker join %s: %v", worker.Address, err)
-			}
+	// Join the additional servers one at a time, as embedded etcd adds one member at a time.
+	for si := range cluster.Servers {
+		server := &cluster.Servers[si]
+		if server.Done && !hasForcedSteps() {
+			continue
+		}
+		if err := joinNode(client, *cluster, server, true, logger.WithPrefix(server.NodeName), commit); err != nil {
+			return fmt.Errorf("server join %s: %v", server.Address, err)
 		}
+		commit(func() { server.Done = true })
+	}
 
-		// Log the kubeconfig files for the cluster.
-		logFiles(logger)
+	// Configure worker nodes for the cluster.
+	err = forEachParallel(len(cluster.Workers), utils.Parallel, func(wi int) error {
+		worker := &cluster.Workers[wi]
+		if worker.Done && !hasForcedSteps() {
+			return nil
+		}
+		if err := joinNode(client, *cluster, worker, false, logger.WithPrefix(worker.NodeName), commit); err != nil {
+			return fmt.Errorf("worker join %s: %v", worker.Address, err)
+		}
+		commit(func() { worker.Done = true })
+		return nil
+	})
+	if err != nil {
+		return err
 	}
-	return clusters, nil
+
+	// Log the kubeconfig files for the cluster.
+	return logFiles(logger)
 }
 
-// sshConnect establishes an SSH connection to a remote host.
+// joinNode connects to a worker or an additional server with its own credentials and joins it to the
+// cluster, skipping steps that already completed on a previous run.
 //
 // Parameters:
-// - user: The username for the SSH connection.
-// - pass: The password for the SSH connection.
-// - host: The address of the remote host.
+// - master: The Executor to the cluster's master node.
+// - cluster: The Cluster object representing the cluster.
+// - node: A pointer to the Worker to join.
+// - server: Whether the node joins as a server rather than an agent.
+// - logger: A pointer to a utils.Logger instance for logging operations.
+// - commit: The checkpoint used to update and persist the node's state.
+//
+// Returns:
+// - An error if the token cannot be read or any step fails.
+func joinNode(master Executor, cluster Cluster, node *Worker, server bool, logger *utils.Logger, commit checkpoint) error {
+	client, err := Dial(&node.Host, cluster.WorkerJump(*node), logger)
+	if err != nil {
+		return err
+	}
+	defer func(client Executor) {
+		if err := client.Close(); err != nil {
+			logger.LogErr("Error closing SSH connection to %s: %v\n", node.Address, err)
+		}
+	}(client)
+
+	prepare := commandStep("base-packages", client, "sudo apt update && sudo apt install -y curl")
+	if airgapped() {
+		prepare = airgapStep(client, false)
+	}
+	steps := []step{prepare}
+	config := func() ([]byte, error) { return agentK3sConfig(cluster, *node) }
+	install := func() error { return installAgent(master, client, cluster) }
+	if server {
+		steps = append(steps, datastoreSteps(client, cluster.Datastore)...)
+		config = func() ([]byte, error) { return joinedServerK3sConfig(cluster, *node) }
+		install = func() error { return installJoinedServer(master, client, cluster) }
+	}
+	logger.Log("Connecting to %s: %s", nodeKind(server), node.Address)
+	err = runSteps(node, append(steps,
+		k3sConfigStep(client, config),
+		step{name: "k3s-install", run: install},
+		// Label the node from the master, where kubectl has cluster access.
+		commandStep("label", master, fmt.Sprintf("kubectl label node %s %s --overwrite", node.NodeName, node.Labels)),
+	), logger, commit)
+	if err != nil {
+		return err
+	}
+	recordK3sVersion(client, node, logger, commit)
+	return nil
+}
+
+// nodeKind names the kind of a joined node in messages.
+//
+// Parameters:
+// - server: Whether the node is an additional server.
 //
 // Returns:
-// - A pointer to an ssh.Client instance.
-// - An error if the connection fails.
-func sshConnect(user, pass, host string) (*ssh.Client, error) {
-	cfg := &ssh.ClientConfig{
-		User:            user,
-		Auth:            []ssh.AuthMethod{ssh.Password(pass)},
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
-	}
-	return ssh.Dial("tcp", host+":22", cfg)
+// - "server" or "worker".
+func nodeKind(server bool) string {
+	if server {
+		return "server"
+	}
+	return "worker"
+}
+
+// installAgent installs the k3s agent on a worker node, joining it to the cluster with a new token,
+// which is masked in the logs, through the registration address, or the first server if none is set.
+//
+// Parameters:
+// - master: The Executor to the cluster's master node.
+// - client: The Executor to the worker node.
+// - cluster: The Cluster object representing the cluster.
+//
+// Returns:
+// - An error if the token cannot be created or the install fails.
+func installAgent(master, client Executor, cluster Cluster) error {
+	// Generate a token for the worker node to join the cluster.
+	token, err := ExecuteRemoteScript(master, "echo $(k3s token create)")
+	if err != nil {
+		return fmt.Errorf("token: %v", err)
+	}
+	token = strings.TrimSpace(token)
+	utils.MaskSecret(token)
+	return client.Run(k3sInstallCommand(cluster, fmt.Sprintf("K3S_URL=https://%s:6443 K3S_TOKEN='%s'", cluster.apiAddress(), token)))
+}
+
+// installJoinedServer installs k3s on an additional server with the server token, which is masked in the logs.
+// It joins the first server's embedded etcd or, with an external datastore, shares it.
+//
+// Parameters:
+// - master: The Executor to the cluster's master node, its first server.
+// - client: The Executor to the additional server.
+// - cluster: The Cluster object representing the cluster.
+//
+// Returns:
+// - An error if the token cannot be read or the install fails.
+func installJoinedServer(master, client Executor, cluster Cluster) error {
+	token, err := master.Output("sudo cat /var/lib/rancher/k3s/server/token")
+	if err != nil {
+		return fmt.Errorf("server token: %v", err)
+	}
+	token = strings.TrimSpace(token)
+	utils.MaskSecret(token)
+	env := fmt.Sprintf("K3S_TOKEN=%s INSTALL_K3S_EXEC=server %s", shellQuote(token), serverInstallEnv)
+	if cluster.embeddedEtcd() {
+		env = fmt.Sprintf("K3S_URL=https://%s:6443 %s", cluster.Address, env)
+	}
+	return client.Run(k3sInstallCommand(cluster, env))
+}
+
+// recordK3sVersion reads the version of the k3s binary installed on a node and records it in the node's state.
+// A failure is only logged, as the install itself succeeded.
+//
+// Parameters:
+// - client: The Executor for the node.
+// - node: A pointer to the Worker whose installed version is updated.
+// - logger: A pointer to a utils.Logger instance for logging operations.
+// - commit: The checkpoint used to update and persist the node's state.
+func recordK3sVersion(client Executor, node *Worker, logger *utils.Logger, commit checkpoint) {
+	out, err := client.Output("k3s --version")
+	if err != nil {
+		logger.LogErr("Failed to read the k3s version on %s: %v\n", node.Address, err)
+		return
+	}
+	if version := parseK3sVersion(out); version != "" {
+		commit(func() { node.InstalledVersion = version })
+	}
+}
+
+// parseK3sVersion extracts the version from the output of `k3s --version`.
+//
+// Parameters:
+// - out: The output, e.g. "k3s version v1.32.3+k3s1 (079ffa8d)".
+//
+// Returns:
+// - The version, e.g. v1.32.3+k3s1, or an empty string if the output is not recognised.
+func parseK3sVersion(out string) string {
+	fields := strings.Fields(out)
+	if len(fields) < 3 || fields[0] != "k3s" || fields[1] != "version" {
+		return ""
+	}
+	return fields[2]
 }
 
 // logFiles reads and logs the contents of kubeconfig files for the cluster.
 //
 // Parameters:
 // - logger: A pointer to a utils.Logger instance for logging operations.
-func logFiles(logger *utils.Logger) {
+//
+// Returns:
+// - An error if the kubeconfigs directory or one of its files cannot be read.
+func logFiles(logger *utils.Logger) error {
 	dir := path.Join("./kubeconfigs", logger.Id)
 	files, err := os.ReadDir(dir)
 	if err != nil {
-		log.Fatalf("read dir: %v", err)
+		return fmt.Errorf("read dir: %v", err)
 	}
 	for _, f := range files {
 		if f.IsDir() {
@@ -127,10 +287,11 @@ func logFiles(logger *utils.Logger) {
 		fp := path.Join(dir, f.Name())
 		data, err := os.ReadFile(fp)
 		if err != nil {
-			log.Fatalf("read file: %v", err)
+			return fmt.Errorf("read file: %v", err)
 		}
 		logger.LogFile(fp, string(data))
 	}
+	return nil
 }
 
 // runLinkerdInstall installs and configures Linkerd on the cluster.
@@ -139,14 +300,26 @@ func logFiles(logger *utils.Logger) {
 // - cluster: The Cluster object representing the cluster.
 // - logger: A pointer to a utils.Logger instance for logging operations.
 // - Multicluster: A boolean indicating whether to install Linkerd multicluster.
-func runLinkerdInstall(cluster Cluster, logger *utils.Logger, multicluster bool) {
+//
+// Returns:
+// - An error if generating the certificates, a linkerd command or applying its manifests fails.
+func runLinkerdInstall(cluster Cluster, logger *utils.Logger, multicluster bool) error {
+	linkerdMu.Lock()
+	defer linkerdMu.Unlock()
+
 	dir := path.Join("./kubeconfigs", logger.Id)
 	kubeconfig := path.Join(dir, fmt.Sprintf("%s.yaml", cluster.NodeName))
 
-	createRootCerts(dir, logger)
-	installCRDs(kubeconfig, logger)
-	createIssuerCerts(dir, cluster, logger)
-	runLinkerdCmd("install", []string{
+	if err := createRootCerts(dir, logger); err != nil {
+		return err
+	}
+	if err := installCRDs(kubeconfig, logger); err != nil {
+		return err
+	}
+	if err := createIssuerCerts(dir, cluster, logger); err != nil {
+		return err
+	}
+	err := runLinkerdCmd("install", []string{
 		"--proxy-log-level=linkerd=debug,warn",
 		"--cluster-domain=cluster.local",
 		"--identity-trust-domain=cluster.local",
@@ -155,15 +328,21 @@ func runLinkerdInstall(cluster Cluster, logger *utils.Logger, multicluster bool)
 		"--identity-issuer-key-file=" + path.Join(dir, fmt.Sprintf("%s-issuer.key", cluster.NodeName)),
 		"--kubeconfig", kubeconfig,
 	}, logger, kubeconfig, true)
+	if err != nil {
+		return err
+	}
 
 	if multicluster {
-		runLinkerdCmd("multicluster", []string{"install", "--kubeconfig", kubeconfig}, logger, kubeconfig, true)
+		if err := runLinkerdCmd("multicluster", []string{"install", "--kubeconfig", kubeconfig}, logger, kubeconfig, true); err != nil {
+			return err
+		}
 		logger.Log("Linkerd multicluster installed.")
-		runLinkerdCmd("multicluster", []string{"check", "--kubeconfig", kubeconfig}, logger, kubeconfig, false)
-	} else {
-		runLinkerdCmd("check", []string{"--pre", "--kubeconfig", kubeconfig}, logger, kubeconfig, true)
-		runLinkerdCmd("check", []string{"--kubeconfig", kubeconfig}, logger, kubeconfig, false)
+		return runLinkerdCmd("multicluster", []string{"check", "--kubeconfig", kubeconfig}, logger, kubeconfig, false)
 	}
+	if err := runLinkerdCmd("check", []string{"--pre", "--kubeconfig", kubeconfig}, logger, kubeconfig, true); err != nil {
+		return err
+	}
+	return runLinkerdCmd("check", []string{"--kubeconfig", kubeconfig}, logger, kubeconfig, false)
 }
 
 // runLinkerdCmd executes a Linkerd command with the specified arguments.
@@ -174,14 +353,16 @@ func runLinkerdInstall(cluster Cluster, logger *utils.Logger, multicluster bool)
 // - logger: A pointer to a utils.Logger instance for logging operations.
 // - kubeconfig: The path to the kubeconfig file.
 // - Apply: A boolean indicating whether to apply the command output.
-func runLinkerdCmd(cmd string, args []string, logger *utils.Logger, kubeconfig string, apply bool) {
+//
+// Returns:
+// - An error if the command fails or its output cannot be applied.
+func runLinkerdCmd(cmd string, args []string, logger *utils.Logger, kubeconfig string, apply bool) error {
 	parts := append([]string{cmd}, args...)
 	c := exec.Command("linkerd", parts...)
 	if apply {
-		pipeAndApply(c, kubeconfig, logger)
-	} else {
-		pipeAndLog(c, logger)
+		return pipeAndApply(c, kubeconfig, logger)
 	}
+	return pipeAndLog(c, logger)
 }
 
 // installCRDs installs the Linkerd CRDs on the cluster.
@@ -189,9 +370,12 @@ func runLinkerdCmd(cmd string, args []string, logger *utils.Logger, kubeconfig s
 // Parameters:
 // - kubeconfig: The path to the kubeconfig file.
 // - logger: A pointer to a utils.Logger instance for logging operations.
-func installCRDs(kubeconfig string, logger *utils.Logger) {
+//
+// Returns:
+// - An error if the CRDs cannot be applied.
+func installCRDs(kubeconfig string, logger *utils.Logger) error {
 	run := exec.Command("linkerd", "install", "--crds", "--kubeconfig", kubeconfig)
-	pipeAndApply(run, kubeconfig, logger)
+	return pipeAndApply(run, kubeconfig, logger)
 }
 
 // createRootCerts generates root certificates for Linkerd.
@@ -200,7 +384,10 @@ func installCRDs(kubeconfig string, logger *utils.Logger) {
 // - dir: The directory to store the certificates.
 // - cluster: The Cluster object representing the cluster.
 // - Logger: A pointer to a utils.Logger instance for logging operations.
-func createRootCerts(dir string, logger *utils.Logger) {
+//
+// Returns:
+// - An error if step fails.
+func createRootCerts(dir string, logger *utils.Logger) error {
 	cmd := exec.Command("step", "certificate", "create",
 		"identity.linkerd.cluster.local",
 		path.Join(dir, "ca.crt"),
@@ -208,7 +395,7 @@ func createRootCerts(dir string, logger *utils.Logger) {
 		"--profile", "root-ca",
 		"--no-password", "--insecure", "--force", "--not-after", "438000h",
 	)
-	pipeAndLog(cmd, logger)
+	return pipeAndLog(cmd, logger)
 }
 
 // createIssuerCerts generates issuer certificates for Linkerd.
@@ -217,7 +404,10 @@ func createRootCerts(dir string, logger *utils.Logger) {
 // - dir: The directory to store the certificates.
 // - cluster: The Cluster object representing the cluster.
 // - Logger: A pointer to a utils.Logger instance for logging operations.
-func createIssuerCerts(dir string, cluster Cluster, logger *utils.Logger) {
+//
+// Returns:
+// - An error if step fails.
+func createIssuerCerts(dir string, cluster Cluster, logger *utils.Logger) error {
 	cmd := exec.Command("step", "certificate", "create",
 		fmt.Sprintf("identity.linkerd.%s", cluster.Domain),
 		path.Join(dir, fmt.Sprintf("%s-issuer.crt", cluster.NodeName)),
@@ -228,7 +418,7 @@ func createIssuerCerts(dir string, cluster Cluster, logger *utils.Logger) {
 		"--not-after", "438000h",
 		"--no-password", "--insecure", "--force",
 	)
-	pipeAndLog(cmd, logger)
+	return pipeAndLog(cmd, logger)
 }
 
 // pipeAndLog streams the output of a command to the logger.
@@ -236,14 +426,40 @@ func createIssuerCerts(dir string, cluster Cluster, logger *utils.Logger) {
 // Parameters:
 // - cmd: The command to execute.
 // - logger: A pointer to a utils.Logger instance for logging operations.
-func pipeAndLog(cmd *exec.Cmd, logger *utils.Logger) {
+//
+// Returns:
+// - An error if the command cannot be started or exits with a non-zero status.
+func pipeAndLog(cmd *exec.Cmd, logger *utils.Logger) error {
 	outPipe, _ := cmd.StdoutPipe()
 	errPipe, _ := cmd.StderrPipe()
-	_ = cmd.Start()
-	go streamOutput(outPipe, false, logger)
-	go streamOutput(errPipe, true, logger)
-	_ = cmd.Wait()
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("%s: %v", commandName(cmd), err)
+	}
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() { defer wg.Done(); streamOutput(outPipe, false, logger) }()
+	go func() { defer wg.Done(); streamOutput(errPipe, true, logger) }()
+	// Wait closes the pipes, so the output must be read first.
+	wg.Wait()
+	if err := cmd.Wait(); err != nil {
+		return fmt.Errorf("%s: %v", commandName(cmd), err)
+	}
 	logger.Log("Command executed successfully")
+	return nil
+}
+
+// commandName names a local command in errors by its program and subcommand, e.g. "linkerd check".
+//
+// Parameters:
+// - cmd: The command.
+//
+// Returns:
+// - The program and its first argument, if any.
+func commandName(cmd *exec.Cmd) string {
+	if len(cmd.Args) < 2 {
+		return cmd.Path
+	}
+	return cmd.Args[0] + " " + cmd.Args[1]
 }
 
 // pipeAndApply streams the output of a command and applies it using kubectl.
@@ -252,105 +468,84 @@ func pipeAndLog(cmd *exec.Cmd, logger *utils.Logger) {
 // - cmd: The command to execute.
 // - kubeconfig: The path to the kubeconfig file.
 // - Logger: A pointer to a utils.Logger instance for logging operations.
-func pipeAndApply(cmd *exec.Cmd, kubeconfig string, logger *utils.Logger) {
-	stdout, _ := cmd.StdoutPipe()
-	stderr, _ := cmd.StderrPipe()
-	_ = cmd.Start()
-
+//
+// Returns:
+// - An error if the command exits with a non-zero status or kubectl apply fails.
+func pipeAndApply(cmd *exec.Cmd, kubeconfig string, logger *utils.Logger) error {
 	var yaml strings.Builder
-	go func(r io.Reader) {
-		scanner := bufio.NewScanner(r)
-		for scanner.Scan() {
-			yaml.WriteString(scanner.Text() + "\n")
-		}
-	}(stdout)
-	go streamOutput(stderr, true, logger)
-	_ = cmd.Wait()
+	cmd.Stdout = &yaml
+	stderr, _ := cmd.StderrPipe()
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("%s: %v", commandName(cmd), err)
+	}
+	// Wait closes the pipe, so stderr must be read first.
+	streamOutput(stderr, true, logger)
+	if err := cmd.Wait(); err != nil {
+		return fmt.Errorf("%s: %v", commandName(cmd), err)
+	}
 
 	apply := exec.Command("kubectl", "--kubeconfig", kubeconfig, "apply", "-f", "-")
 	apply.Stdin = strings.NewReader(yaml.String())
 	out, err := apply.CombinedOutput()
 	if err != nil {
-		log.Fatalf("apply failed: %v\n%s", err, string(out))
+		return fmt.Errorf("apply failed: %v\n%s", err, string(out))
 	}
 	logger.Log("Apply output:\n%s", string(out))
+	return nil
 }
 
-// baseClusterCommands returns a list of base commands for setting up a cluster.
+// baseClusterSteps returns the base steps for setting up a cluster's master node.
 //
 // Parameters:
+// - client: The Executor for the master node.
 // - cluster: The Cluster object representing the cluster.
 //
 // Returns:
-// - A slice of strings containing the base commands.
-func baseClusterCommands(cluster Cluster) []string {
-	return []string{
+// - A slice of steps installing base packages, or uploading the air-gap bundle, uploading the datastore's TLS files
+// and the k3s config, installing k3s, and labelling the node.
+func baseClusterSteps(client Executor, cluster Cluster) []step {
+	prepare := commandStep("base-packages", client,
 		"sudo apt-get update -y",
-		"sudo apt-get install curl wget zip unzip -y",
-		fmt.Sprintf("cd /tmp && curl -L -o source.zip $(curl -s https://api.github.com/repos/argon-chat/k3sd/releases/tags/%s | grep \"zipball_url\" | cut -d '\"' -f 4)", utils.Version),
-		"unzip -o -j /tmp/source.zip -d /tmp/yamls",
-		"curl -sfL https://get.k3s.io | INSTALL_K3S_EXEC=\"--disable traefik\" K3S_KUBECONFIG_MODE=\"644\" sh -",
-		"sleep 10",
-		fmt.Sprintf("kubectl label node %s %s --overwrite", cluster.NodeName, cluster.Labels),
-	}
-}
-
-// appendOptionalApps appends optional application installation commands to the provided command list.
-//
-// Parameters:
-// - commands: A pointer to a slice of strings containing the commands.
-// - domain: The domain name for the cluster.
-func appendOptionalApps(commands *[]string, domain string, pg Pg) {
-	if utils.Flags["prometheus"] {
-		*commands = append(*commands,
-			"curl -fsSL https://raw.githubusercontent.com/helm/helm/main/scripts/get-helm-3 | bash",
-			"helm version",
-			"helm repo add prometheus-community https://prometheus-community.github.io/helm-charts",
-			"helm repo update prometheus-community",
-			"KUBECONFIG=/etc/rancher/k3s/k3s.yaml helm upgrade --install kube-prom-stack prometheus-community/kube-prometheus-stack --version \"35.5.1\" --namespace monitoring --create-namespace -f /tmp/yamls/prom-stack-values.yaml",
-		)
-	}
-	if utils.Flags["cert-manager"] {
-		*commands = append(*commands,
-			"kubectl apply -f https://github.com/cert-manager/cert-manager/releases/download/v1.17.2/cert-manager.crds.yaml",
-			"kubectl apply -f https://github.com/cert-manager/cert-manager/releases/download/v1.17.2/cert-manager.yaml",
-			"sleep 30",
-		)
-	}
-	if utils.Flags["traefik-values"] {
-		*commands = append(*commands,
-			"kubectl apply -f /tmp/yamls/traefik-values.yaml",
-			"while ! kubectl get deploy -n kube-system | grep -q traefik; do sleep 5; done; while [ $(kubectl get deploy -n kube-system | grep traefik | awk '{print $2}') != \"1/1\" ]; do sleep 5; done",
-		)
-	}
-	if utils.Flags["clusterissuer"] {
-		*commands = append(*commands, fmt.Sprintf("cat /tmp/yamls/clusterissuer.yaml | DOMAIN=%s envsubst | kubectl apply -f -", domain))
-	}
-	if utils.Flags["gitea"] {
-		*commands = append(*commands, fmt.Sprintf("cat /tmp/yamls/gitea.yaml | POSTGRES_USER=%s POSTGRES_PASSWORD=%s POSTGRES_DB=%s  envsubst | kubectl apply -f -", pg.Username, pg.Password, pg.DbName))
-		if utils.Flags["gitea-ingress"] {
-			*commands = append(*commands, fmt.Sprintf("cat /tmp/yamls/gitea.ingress.yaml | DOMAIN=%s envsubst | kubectl apply -f -", domain))
-		}
+		"sudo apt-get install curl -y",
+	)
+	if airgapped() {
+		prepare = airgapStep(client, true)
 	}
+	steps := append([]step{prepare}, datastoreSteps(client, cluster.Datastore)...)
+	return append(steps,
+		k3sConfigStep(client, func() ([]byte, error) { return serverK3sConfig(cluster) }),
+		commandStep("k3s-install", client,
+			k3sInstallCommand(cluster, serverInstallEnv),
+			"sleep 10",
+		),
+		commandStep("label", client, fmt.Sprintf("kubectl label node %s %s --overwrite", cluster.NodeName, cluster.Labels)),
+	)
 }
 
-// saveKubeConfig retrieves and saves the kubeconfig file for the cluster.
+// saveKubeConfig retrieves and saves the kubeconfig file for the cluster, pointing at the registration
+// address if set, otherwise at the first server.
 //
 // Parameters:
-// - client: A pointer to an ssh.Client instance for the SSH connection.
+// - client: The Executor for the master node.
 // - cluster: The Cluster object representing the cluster.
 // - nodeName: The name of the node.
 // - logger: A pointer to a utils.Logger instance for logging operations.
-func saveKubeConfig(client *ssh.Client, cluster Cluster, nodeName string, logger *utils.Logger) {
-	kubeConfig, err := ExecuteRemoteScript(client, "cat /etc/rancher/k3s/k3s.yaml", logger)
+//
+// Returns:
+// - The path of the saved kubeconfig.
+// - An error if the kubeconfig cannot be read or written.
+func saveKubeConfig(client Executor, cluster Cluster, nodeName string, logger *utils.Logger) (string, error) {
+	kubeConfig, err := ExecuteRemoteScript(client, "cat /etc/rancher/k3s/k3s.yaml")
 	if err != nil {
-		logger.Log("Failed to read kubeconfig from %s: %v\n", cluster.Address, err)
-		return
+		return "", fmt.Errorf("read kubeconfig from %s: %v", cluster.Address, err)
 	}
-	kubeConfig = strings.Replace(kubeConfig, "127.0.0.1", cluster.Address, -1)
+	kubeConfig = strings.Replace(kubeConfig, "127.0.0.1", cluster.apiAddress(), -1)
 
 	kubeConfigPath := path.Join("./kubeconfigs", fmt.Sprintf("%s/%s.yaml", logger.Id, nodeName))
-	createFile(kubeConfigPath, kubeConfig)
+	if err := createFile(kubeConfigPath, kubeConfig); err != nil {
+		return "", err
+	}
+	return kubeConfigPath, nil
 }
 
 // createFile creates a file with the specified content.
@@ -358,12 +553,15 @@ func saveKubeConfig(client *ssh.Client, cluster Cluster, nodeName string, logger
 // Parameters:
 // - filePath: The path to the file to be created.
 // - content: The content to write to the file.
-// - Logger: A pointer to a utils.Logger instance for logging operations.
-func createFile(filePath, content string) {
+//
+// Returns:
+// - An error if the directory or the file cannot be written.
+func createFile(filePath, content string) error {
 	if err := os.MkdirAll(path.Dir(filePath), os.ModePerm); err != nil {
-		log.Fatalf("Error creating directory: %v\n", err)
+		return fmt.Errorf("create directory: %v", err)
 	}
 	if err := os.WriteFile(filePath, []byte(content), 0644); err != nil {
-		log.Fatalf("Error writing kubeconfig to file: %v\n", err)
+		return fmt.Errorf("write kubeconfig to file: %v", err)
 	}
+	return nil
 }
@@ -0,0 +1,105 @@
+package cluster
+
+import (
+	"github.com/argon-chat/k3sd/utils"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"testing"
+)
+
+func TestCreateClusterCommands(t *testing.T) {
+	t.Chdir(t.TempDir())
+	dialer := NewFakeDialer()
+	previous := Dial
+	Dial = dialer.Dial
+	t.Cleanup(func() { Dial = previous })
+	parallel := utils.Parallel
+	utils.Parallel = 2
+	t.Cleanup(func() { utils.Parallel = parallel })
+
+	master := dialer.Executor("10.0.0.1")
+	master.Results["bash -c 'cat /etc/rancher/k3s/k3s.yaml'"] = FakeResult{Output: "server: https://127.0.0.1:6443\n"}
+	master.Results["bash -c 'echo $(k3s token create)'"] = FakeResult{Output: "K10token\n"}
+	for _, address := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"} {
+		dialer.Executor(address).Results["k3s --version"] = FakeResult{Output: "k3s version v1.32.3+k3s1 (079ffa8d)\n"}
+	}
+
+	cluster := Cluster{K3sVersion: "v1.32.3+k3s1"}
+	cluster.Address, cluster.NodeName, cluster.Labels = "10.0.0.1", "master", "role=master"
+	for _, worker := range []struct{ address, name string }{{"10.0.0.2", "worker-1"}, {"10.0.0.3", "worker-2"}} {
+		var node Worker
+		node.Address, node.NodeName, node.Labels = worker.address, worker.name, "role=worker"
+		cluster.Workers = append(cluster.Workers, node)
+	}
+
+	clusters, err := CreateCluster([]Cluster{cluster}, newTestLogger(), nil, nil)
+	if err != nil {
+		t.Fatalf("CreateCluster: %v", err)
+	}
+
+	installConfig := "sudo mkdir -p /etc/rancher/k3s && sudo install -m 0600 /tmp/k3sd/config.yaml /etc/rancher/k3s/config.yaml && rm -f /tmp/k3sd/config.yaml"
+	setup := []string{
+		"sudo apt-get update -y",
+		"sudo apt-get install curl -y",
+		installConfig,
+		`curl -sfL https://get.k3s.io | INSTALL_K3S_VERSION=v1.32.3+k3s1 K3S_KUBECONFIG_MODE="644" sh -`,
+		"sleep 10",
+		"kubectl label node master role=master --overwrite",
+		"k3s --version",
+		"bash -c 'cat /etc/rancher/k3s/k3s.yaml'",
+	}
+	if len(master.Commands) < len(setup) || !reflect.DeepEqual(master.Commands[:len(setup)], setup) {
+		t.Fatalf("master commands = %q, want them to start with %q", master.Commands, setup)
+	}
+	// The two workers join at once, so the commands they run on the master may interleave.
+	joins := slices.Sorted(slices.Values(master.Commands[len(setup):]))
+	wantJoins := []string{
+		"bash -c 'echo $(k3s token create)'",
+		"bash -c 'echo $(k3s token create)'",
+		"kubectl label node worker-1 role=worker --overwrite",
+		"kubectl label node worker-2 role=worker --overwrite",
+	}
+	if !reflect.DeepEqual(joins, wantJoins) {
+		t.Errorf("master commands for the workers = %q, want %q", joins, wantJoins)
+	}
+
+	for _, address := range []string{"10.0.0.2", "10.0.0.3"} {
+		worker := dialer.Executor(address)
+		want := []string{
+			"sudo apt update && sudo apt install -y curl",
+			installConfig,
+			"curl -sfL https://get.k3s.io | INSTALL_K3S_VERSION=v1.32.3+k3s1 K3S_URL=https://10.0.0.1:6443 K3S_TOKEN='K10token' sh -",
+			"k3s --version",
+		}
+		if !reflect.DeepEqual(worker.Commands, want) {
+			t.Errorf("worker %s commands = %q, want %q", address, worker.Commands, want)
+		}
+		if _, ok := worker.Uploads[k3sConfigUpload]; !ok {
+			t.Errorf("worker %s has no k3s config uploaded", address)
+		}
+	}
+
+	for address, executor := range dialer.Executors {
+		if !executor.Closed {
+			t.Errorf("connection to %s was not closed", address)
+		}
+	}
+	kubeconfig, err := os.ReadFile(filepath.Join("kubeconfigs", "test", "master.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(kubeconfig); got != "server: https://10.0.0.1:6443\n" {
+		t.Errorf("kubeconfig = %q, want the server at 10.0.0.1", got)
+	}
+	created := clusters[0]
+	if !created.Done || created.InstalledVersion != "v1.32.3+k3s1" {
+		t.Errorf("master done = %v, version = %q", created.Done, created.InstalledVersion)
+	}
+	for _, worker := range created.Workers {
+		if !worker.Done || worker.InstalledVersion != "v1.32.3+k3s1" {
+			t.Errorf("worker %s done = %v, version = %q", worker.NodeName, worker.Done, worker.InstalledVersion)
+		}
+	}
+}
@@ -0,0 +1,358 @@
+package cluster
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"filippo.io/age"
+	"filippo.io/age/armor"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// AgeKeyFileEnv names the environment variable holding the path of the age identities used to
+// decrypt encrypted configs.
+const AgeKeyFileEnv = "K3SD_AGE_KEY_FILE"
+
+// Headers identifying a file encrypted with age, in its armored and binary forms.
+const (
+	ageArmorHeader  = "-----BEGIN AGE ENCRYPTED FILE-----"
+	ageBinaryHeader = "age-encryption.org/v1\n"
+)
+
+// sopsMetadataKey is the top-level key under which SOPS keeps its metadata.
+const sopsMetadataKey = "sops"
+
+// sopsValuePattern matches a value encrypted by SOPS.
+var sopsValuePattern = regexp.MustCompile(`^ENC\[AES256_GCM,data:(.*),iv:(.+),tag:(.+),type:(.+)\]$`)
+
+// sopsMetadata is the part of the SOPS metadata needed to decrypt and verify a document.
+type sopsMetadata struct {
+	Age []struct {
+		Recipient string `yaml:"recipient"` // Public key the data key is encrypted to.
+		Enc       string `yaml:"enc"`       // Armored age ciphertext of the data key.
+	} `yaml:"age"`
+	LastModified     string `yaml:"lastmodified"`       // Modification time, authenticated with the MAC.
+	MAC              string `yaml:"mac"`                // Encrypted SHA-512 of the document's values.
+	MACOnlyEncrypted bool   `yaml:"mac_only_encrypted"` // Whether the MAC covers encrypted values only.
+}
+
+// isAgeEncrypted reports whether data is a file encrypted with age.
+func isAgeEncrypted(data []byte) bool {
+	return bytes.HasPrefix(bytes.TrimSpace(data), []byte(ageArmorHeader)) || bytes.HasPrefix(data, []byte(ageBinaryHeader))
+}
+
+// loadAgeIdentities reads the age identities from the file named by K3SD_AGE_KEY_FILE.
+//
+// Returns:
+//   - []age.Identity: The identities.
+//   - error: An error if the variable is unset or the file cannot be read or parsed.
+func loadAgeIdentities() ([]age.Identity, error) {
+	path := os.Getenv(AgeKeyFileEnv)
+	if path == "" {
+		return nil, fmt.Errorf("the config is encrypted but %s is not set", AgeKeyFileEnv)
+	}
+	file, err := os.Open(expandHome(path))
+	if err != nil {
+		return nil, fmt.Errorf("open age key file: %w", err)
+	}
+	defer file.Close()
+
+	identities, err := age.ParseIdentities(file)
+	if err != nil {
+		return nil, fmt.Errorf("parse age key file: %w", err)
+	}
+	return identities, nil
+}
+
+// decryptAge decrypts an armored or binary age file with the identities from K3SD_AGE_KEY_FILE.
+//
+// Parameters:
+//   - data: The encrypted file.
+//
+// Returns:
+//   - []byte: The plaintext.
+//   - error: An error if no identity can decrypt the file.
+func decryptAge(data []byte) ([]byte, error) {
+	identities, err := loadAgeIdentities()
+	if err != nil {
+		return nil, err
+	}
+	var src io.Reader = bytes.NewReader(data)
+	if !bytes.HasPrefix(data, []byte(ageBinaryHeader)) {
+		src = armor.NewReader(bytes.NewReader(bytes.TrimSpace(data)))
+	}
+	plaintext, err := age.Decrypt(src, identities...)
+	if err != nil {
+		return nil, fmt.Errorf("decrypt with age: %w", err)
+	}
+	return io.ReadAll(plaintext)
+}
+
+// encryptAge encrypts data to age recipients as an armored file.
+//
+// Parameters:
+//   - data: The plaintext.
+//   - recipients: The recipients that can decrypt the result.
+//
+// Returns:
+//   - []byte: The armored ciphertext.
+//   - error: An error if encryption fails.
+func encryptAge(data []byte, recipients []age.Recipient) ([]byte, error) {
+	var buf bytes.Buffer
+	armored := armor.NewWriter(&buf)
+	w, err := age.Encrypt(armored, recipients...)
+	if err != nil {
+		return nil, fmt.Errorf("encrypt with age: %w", err)
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, fmt.Errorf("encrypt with age: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return nil, fmt.Errorf("encrypt with age: %w", err)
+	}
+	if err := armored.Close(); err != nil {
+		return nil, fmt.Errorf("encrypt with age: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// configRecipients returns the age recipients that the state of an encrypted config is encrypted to:
+// the age recipients listed in its SOPS metadata, or those of the identities in K3SD_AGE_KEY_FILE
+// for a config encrypted as a whole.
+//
+// Parameters:
+//   - path: The path of the cluster config.
+//
+// Returns:
+//   - []age.Recipient: The recipients, or nil if the config is not encrypted.
+//   - error: An error if the config or the key file cannot be read.
+func configRecipients(path string) ([]age.Recipient, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read cluster config: %w", err)
+	}
+
+	if isAgeEncrypted(data) {
+		identities, err := loadAgeIdentities()
+		if err != nil {
+			return nil, err
+		}
+		var recipients []age.Recipient
+		for _, identity := range identities {
+			if x25519, ok := identity.(*age.X25519Identity); ok {
+				recipients = append(recipients, x25519.Recipient())
+			}
+		}
+		if len(recipients) == 0 {
+			return nil, errors.New("no X25519 identity in the age key file to encrypt the state to")
+		}
+		return recipients, nil
+	}
+
+	root, err := parseDocument(path, data)
+	if err != nil {
+		return nil, nil
+	}
+	metaNode := childNode(root, sopsMetadataKey)
+	if metaNode == nil || root.Kind != yaml.MappingNode {
+		return nil, nil
+	}
+	var meta sopsMetadata
+	if err := metaNode.Decode(&meta); err != nil {
+		return nil, fmt.Errorf("decode sops metadata: %w", err)
+	}
+	var recipients []age.Recipient
+	for _, entry := range meta.Age {
+		recipient, err := age.ParseX25519Recipient(entry.Recipient)
+		if err != nil {
+			return nil, fmt.Errorf("parse sops age recipient: %w", err)
+		}
+		recipients = append(recipients, recipient)
+	}
+	if len(recipients) == 0 {
+		return nil, errors.New("sops metadata lists no age recipients")
+	}
+	return recipients, nil
+}
+
+// decryptSOPS decrypts a SOPS-encrypted document in place and verifies its MAC. Only age keys
+// are supported. Documents without SOPS metadata are left unchanged.
+//
+// Parameters:
+//   - root: The root node of the document; its SOPS metadata is removed.
+//
+// Returns:
+//   - error: An error if the data key cannot be decrypted, a value cannot be decrypted,
+//     or the MAC does not match.
+func decryptSOPS(root *yaml.Node) error {
+	if root.Kind != yaml.MappingNode {
+		return nil
+	}
+	metaIndex := -1
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		if root.Content[i].Value == sopsMetadataKey {
+			metaIndex = i
+		}
+	}
+	if metaIndex < 0 {
+		return nil
+	}
+
+	var meta sopsMetadata
+	if err := root.Content[metaIndex+1].Decode(&meta); err != nil {
+		return fmt.Errorf("decode sops metadata: %w", err)
+	}
+	if len(meta.Age) == 0 {
+		return errors.New("sops metadata lists no age recipients; only age keys are supported")
+	}
+	identities, err := loadAgeIdentities()
+	if err != nil {
+		return err
+	}
+	var dataKey []byte
+	for _, entry := range meta.Age {
+		plaintext, err := age.Decrypt(armor.NewReader(strings.NewReader(strings.TrimSpace(entry.Enc))), identities...)
+		if err != nil {
+			continue
+		}
+		if dataKey, err = io.ReadAll(plaintext); err == nil {
+			break
+		}
+	}
+	if dataKey == nil {
+		return fmt.Errorf("none of the identities in %s can decrypt the sops data key", AgeKeyFileEnv)
+	}
+	root.Content = append(root.Content[:metaIndex], root.Content[metaIndex+2:]...)
+
+	hash := sha512.New()
+	var walk func(node *yaml.Node, path []string) error
+	walk = func(node *yaml.Node, path []string) error {
+		switch node.Kind {
+		case yaml.MappingNode:
+			for i := 0; i+1 < len(node.Content); i += 2 {
+				if err := walk(node.Content[i+1], append(path, node.Content[i].Value)); err != nil {
+					return err
+				}
+			}
+		case yaml.SequenceNode:
+			// SOPS authenticates list items with the path of the list itself.
+			for _, item := range node.Content {
+				if err := walk(item, path); err != nil {
+					return err
+				}
+			}
+		case yaml.ScalarNode:
+			if !sopsValuePattern.MatchString(node.Value) {
+				if !meta.MACOnlyEncrypted {
+					hash.Write(sopsMACBytes(node.Value, node.ShortTag()))
+				}
+				return nil
+			}
+			value, valueType, err := decryptSOPSValue(dataKey, node.Value, strings.Join(path, ":")+":")
+			if err != nil {
+				return fmt.Errorf("decrypt %s: %w", strings.Join(path, "."), err)
+			}
+			node.Value = value
+			node.Style = 0
+			switch valueType {
+			case "int":
+				node.Tag = "!!int"
+			case "float":
+				node.Tag = "!!float"
+			case "bool":
+				node.Tag = "!!bool"
+			default:
+				node.Tag = "!!str"
+			}
+			hash.Write(sopsMACBytes(value, node.Tag))
+		}
+		return nil
+	}
+	if err := walk(root, nil); err != nil {
+		return err
+	}
+
+	mac, _, err := decryptSOPSValue(dataKey, meta.MAC, meta.LastModified)
+	if err != nil {
+		return fmt.Errorf("decrypt sops mac: %w", err)
+	}
+	if !strings.EqualFold(mac, fmt.Sprintf("%X", hash.Sum(nil))) {
+		return errors.New("sops mac mismatch: the config was modified after it was encrypted")
+	}
+	return nil
+}
+
+// decryptSOPSValue decrypts a single SOPS value.
+//
+// Parameters:
+//   - key: The SOPS data key.
+//   - value: The encrypted value, ENC[AES256_GCM,data:...,iv:...,tag:...,type:...].
+//   - additionalData: The authenticated data: the value's key path joined and terminated by ":".
+//
+// Returns:
+//   - string: The plaintext.
+//   - string: The SOPS type of the value: str, int, float, bool or bytes.
+//   - error: An error if the value is malformed or fails authentication.
+func decryptSOPSValue(key []byte, value, additionalData string) (string, string, error) {
+	match := sopsValuePattern.FindStringSubmatch(value)
+	if match == nil {
+		return "", "", errors.New("not a sops encrypted value")
+	}
+	var parts [3][]byte
+	for i, encoded := range match[1:4] {
+		decoded, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return "", "", fmt.Errorf("decode value: %w", err)
+		}
+		parts[i] = decoded
+	}
+	data, iv, tag := parts[0], parts[1], parts[2]
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return "", "", err
+	}
+	gcm, err := cipher.NewGCMWithNonceSize(block, len(iv))
+	if err != nil {
+		return "", "", err
+	}
+	plaintext, err := gcm.Open(nil, iv, append(data, tag...), []byte(additionalData))
+	if err != nil {
+		return "", "", fmt.Errorf("authenticate value: %w", err)
+	}
+	return string(plaintext), match[4], nil
+}
+
+// sopsMACBytes returns the bytes SOPS feeds into its MAC for a value.
+//
+// Parameters:
+//   - value: The plaintext value.
+//   - tag: The YAML tag of the value.
+//
+// Returns:
+//   - []byte: The bytes hashed by SOPS.
+func sopsMACBytes(value, tag string) []byte {
+	switch tag {
+	case "!!bool":
+		if b, err := strconv.ParseBool(value); err == nil && b {
+			return []byte("True")
+		}
+		return []byte("False")
+	case "!!float":
+		if f, err := strconv.ParseFloat(value, 64); err == nil {
+			return []byte(strconv.FormatFloat(f, 'f', -1, 64))
+		}
+	case "!!null":
+		return nil
+	}
+	return []byte(value)
+}
@@ -0,0 +1,145 @@
+package cluster
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+	"gopkg.in/yaml.v3"
+)
+
+// sopsMAC matches the encrypted MAC of a SOPS document, capturing the first character of its data.
+var sopsMAC = regexp.MustCompile(`(mac"?: "?ENC\[AES256_GCM,data:)(.)`)
+
+func TestDecryptSOPS(t *testing.T) {
+	t.Setenv(AgeKeyFileEnv, filepath.Join("testdata", "sops", "key.txt"))
+	replace := func(old, new string) func(string) string {
+		return func(s string) string { return strings.Replace(s, old, new, 1) }
+	}
+	tests := []struct {
+		name    string
+		fixture string
+		edit    func(string) string // Applied to the fixture and to the expected plaintext.
+		wantErr string
+	}{
+		{name: "yaml", fixture: "clusters.enc.yaml"},
+		{name: "json", fixture: "clusters.enc.json"},
+		{name: "encrypted_regex", fixture: "clusters.partial.enc.yaml"},
+		{name: "mac_only_encrypted", fixture: "clusters.maconly.enc.yaml"},
+		{name: "mac_only_encrypted ignores an edited plaintext value", fixture: "clusters.maconly.enc.yaml", edit: replace("10.0.0.2", "10.0.0.9")},
+		{name: "edited plaintext value", fixture: "clusters.partial.enc.yaml", edit: replace("10.0.0.2", "10.0.0.9"), wantErr: "sops mac mismatch"},
+		{name: "edited plaintext leaf of a nested list", fixture: "clusters.partial.enc.yaml", edit: replace("- 2.25", "- 2.5"), wantErr: "sops mac mismatch"},
+		{name: "edited lastmodified", fixture: "clusters.enc.yaml", edit: replace("2025-05-01T10:00:00Z", "2025-05-02T10:00:00Z"), wantErr: "decrypt sops mac"},
+		{name: "tampered mac", fixture: "clusters.enc.yaml", edit: func(s string) string {
+			return sopsMAC.ReplaceAllStringFunc(s, func(m string) string {
+				if strings.HasSuffix(m, "A") {
+					return m[:len(m)-1] + "B"
+				}
+				return m[:len(m)-1] + "A"
+			})
+		}, wantErr: "decrypt sops mac"},
+	}
+	plain, err := os.ReadFile(filepath.Join("testdata", "sops", "plain.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := os.ReadFile(filepath.Join("testdata", "sops", tt.fixture))
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected := string(plain)
+			if tt.edit != nil {
+				data, expected = []byte(tt.edit(string(data))), tt.edit(expected)
+			}
+			root, err := parseConfig(tt.fixture, data)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseConfig: %v", err)
+			}
+			var got, want any
+			if err := root.Decode(&got); err != nil {
+				t.Fatal(err)
+			}
+			if err := yaml.Unmarshal([]byte(expected), &want); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("got %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestDecryptSOPSWrongKey(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(t.TempDir(), "key.txt")
+	if err := os.WriteFile(keyFile, []byte(identity.String()+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(AgeKeyFileEnv, keyFile)
+	data, err := os.ReadFile(filepath.Join("testdata", "sops", "clusters.enc.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := parseConfig("clusters.enc.yaml", data); err == nil || !strings.Contains(err.Error(), "none of the identities") {
+		t.Fatalf("got error %v, want none of the identities", err)
+	}
+}
+
+func TestConfigRecipients(t *testing.T) {
+	const recipient = "age1ppl4fltlxh3rqdeqvfcdds42fca4r8mfmcnzh8xlwfk4pj75ppmsaxvc9n"
+	tests := []struct {
+		name    string
+		fixture string
+		file    string // Name the fixture is copied to.
+		edit    func(string) string
+		want    []string
+	}{
+		{name: "yaml", fixture: "clusters.enc.yaml", file: "clusters.yaml", want: []string{recipient}},
+		{name: "tab-indented json", fixture: "clusters.enc.json", file: "clusters.json", want: []string{recipient}},
+		{name: "jsonc with comments", fixture: "clusters.enc.json", file: "clusters.jsonc", edit: func(s string) string {
+			return "// Production clusters.\n" + strings.Replace(s, "{", "{ /* encrypted with sops */", 1)
+		}, want: []string{recipient}},
+		{name: "plaintext", fixture: "plain.yaml", file: "clusters.yaml"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := os.ReadFile(filepath.Join("testdata", "sops", tt.fixture))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.edit != nil {
+				data = []byte(tt.edit(string(data)))
+			}
+			path := filepath.Join(t.TempDir(), tt.file)
+			if err := os.WriteFile(path, data, 0600); err != nil {
+				t.Fatal(err)
+			}
+			recipients, err := configRecipients(path)
+			if err != nil {
+				t.Fatalf("configRecipients: %v", err)
+			}
+			var got []string
+			for _, r := range recipients {
+				got = append(got, r.(*age.X25519Recipient).String())
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("recipients = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,33 @@
+package cluster
+
+import (
+	"github.com/argon-chat/k3sd/utils"
+	"io"
+	"os"
+)
+
+// Executor runs commands and places files on a single node.
+//
+// The SSH implementation is *Connection; FakeExecutor records calls in memory for tests.
+type Executor interface {
+	// Run executes a command, streaming its output to the logger.
+	Run(cmd string) error
+	// Output executes a command and returns its standard output.
+	Output(cmd string) (string, error)
+	// Upload writes content to a file on the node with the given permissions.
+	Upload(remotePath string, content []byte, mode os.FileMode) error
+	// UploadStream writes what a reader yields to a file on the node with the given permissions,
+	// without holding it in memory.
+	UploadStream(remotePath string, content io.Reader, mode os.FileMode) error
+	// Close releases the connection to the node.
+	Close() error
+}
+
+// Dialer opens an Executor for a host, hopping through any bastion hosts.
+type Dialer func(host *Host, jump []Host, logger *utils.Logger) (Executor, error)
+
+// Dial is the Dialer used by CreateCluster and UninstallCluster. It connects over SSH
+// by default and can be replaced, e.g. with FakeDialer.Dial in tests.
+var Dial Dialer = func(host *Host, jump []Host, logger *utils.Logger) (Executor, error) {
+	return Connect(host, jump, logger)
+}
@@ -0,0 +1,119 @@
+package cluster
+
+import (
+	"github.com/argon-chat/k3sd/utils"
+	"io"
+	"os"
+	"sync"
+)
+
+// FakeResult is the scripted outcome of a command run on a FakeExecutor.
+type FakeResult struct {
+	Output string // Standard output returned by Output.
+	Err    error  // Error returned by Run or Output.
+}
+
+// FakeExecutor is an in-memory Executor that records every call and returns scripted results.
+type FakeExecutor struct {
+	Address  string                // Address of the host the executor was dialled for.
+	Commands []string              // Commands passed to Run and Output, in order.
+	Uploads  map[string][]byte     // Uploaded file contents, keyed by remote path.
+	Results  map[string]FakeResult // Scripted results, keyed by exact command.
+	Closed   bool                  // Indicates if Close has been called.
+
+	mu sync.Mutex
+}
+
+// NewFakeExecutor creates an empty FakeExecutor for an address.
+//
+// Parameters:
+//   - address: The address of the host the executor stands in for.
+//
+// Returns:
+//   - *FakeExecutor: The new executor.
+func NewFakeExecutor(address string) *FakeExecutor {
+	return &FakeExecutor{
+		Address: address,
+		Uploads: map[string][]byte{},
+		Results: map[string]FakeResult{},
+	}
+}
+
+// Run records the command and returns its scripted error.
+func (f *FakeExecutor) Run(cmd string) error {
+	_, err := f.Output(cmd)
+	return err
+}
+
+// Output records the command and returns its scripted output and error.
+func (f *FakeExecutor) Output(cmd string) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.Commands = append(f.Commands, cmd)
+	result := f.Results[cmd]
+	return result.Output, result.Err
+}
+
+// Upload records the uploaded content under its remote path.
+func (f *FakeExecutor) Upload(remotePath string, content []byte, _ os.FileMode) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.Uploads[remotePath] = append([]byte(nil), content...)
+	return nil
+}
+
+// UploadStream reads the content and records it under its remote path.
+func (f *FakeExecutor) UploadStream(remotePath string, content io.Reader, mode os.FileMode) error {
+	data, err := io.ReadAll(content)
+	if err != nil {
+		return err
+	}
+	return f.Upload(remotePath, data, mode)
+}
+
+// Close marks the executor as closed.
+func (f *FakeExecutor) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.Closed = true
+	return nil
+}
+
+// FakeDialer hands out one FakeExecutor per host address, creating them on first dial.
+type FakeDialer struct {
+	Executors map[string]*FakeExecutor // Executors keyed by host address.
+
+	mu sync.Mutex
+}
+
+// NewFakeDialer creates a FakeDialer with no executors.
+//
+// Returns:
+//   - *FakeDialer: The new dialer.
+func NewFakeDialer() *FakeDialer {
+	return &FakeDialer{Executors: map[string]*FakeExecutor{}}
+}
+
+// Executor returns the FakeExecutor for an address, creating it if needed, so that
+// results can be scripted before the host is dialled.
+//
+// Parameters:
+//   - address: The address of the host.
+//
+// Returns:
+//   - *FakeExecutor: The executor for the address.
+func (d *FakeDialer) Executor(address string) *FakeExecutor {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	executor, ok := d.Executors[address]
+	if !ok {
+		executor = NewFakeExecutor(address)
+		d.Executors[address] = executor
+	}
+	return executor
+}
+
+// Dial implements Dialer by returning the FakeExecutor for the host's address.
+func (d *FakeDialer) Dial(host *Host, _ []Host, _ *utils.Logger) (Executor, error) {
+	return d.Executor(host.Address), nil
+}
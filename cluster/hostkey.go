@@ -0,0 +1,85 @@
+package cluster
+
+import (
+	"errors"
+	"fmt"
+	"github.com/argon-chat/k3sd/utils"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"net"
+	"os"
+)
+
+// Host key policies accepted by the --host-key-policy flag.
+const (
+	HostKeyStrict   = "strict"   // Only accept hosts listed in ~/.ssh/known_hosts.
+	HostKeyTOFU     = "tofu"     // Honour known_hosts, otherwise pin the first key seen in the config.
+	HostKeyInsecure = "insecure" // Accept any host key.
+)
+
+// hostKeyCallback returns the ssh.HostKeyCallback for a host according to utils.HostKeyPolicy.
+//
+// In TOFU mode a host that is not listed in ~/.ssh/known_hosts is checked against the
+// fingerprint pinned in host.HostKey. If nothing is pinned yet, the observed fingerprint
+// is recorded there so that SaveClusters persists it and later runs refuse a changed key.
+//
+// Parameters:
+//   - host: A pointer to the Host whose HostKey is checked and, in TOFU mode, recorded.
+//
+// Returns:
+//   - ssh.HostKeyCallback: The callback to use in the ssh.ClientConfig.
+//   - error: An error if the policy is unknown or known_hosts cannot be read.
+func hostKeyCallback(host *Host) (ssh.HostKeyCallback, error) {
+	switch utils.HostKeyPolicy {
+	case HostKeyInsecure:
+		return ssh.InsecureIgnoreHostKey(), nil
+	case HostKeyStrict:
+		return knownhosts.New(knownHostsPath())
+	case HostKeyTOFU, "":
+		known, err := knownhosts.New(knownHostsPath())
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+		return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			if known != nil {
+				err := known(hostname, remote, key)
+				var keyErr *knownhosts.KeyError
+				if err == nil || !errors.As(err, &keyErr) || len(keyErr.Want) > 0 {
+					return err
+				}
+			}
+			return pinHostKey(host, key)
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown host key policy %q", utils.HostKeyPolicy)
+	}
+}
+
+// pinHostKey compares a host key against the fingerprint pinned on the host,
+// recording it if none has been pinned yet.
+//
+// Parameters:
+//   - host: A pointer to the Host holding the pinned fingerprint.
+//   - key: The host key presented by the remote host.
+//
+// Returns:
+//   - error: An error if the presented key does not match the pinned fingerprint.
+func pinHostKey(host *Host, key ssh.PublicKey) error {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+
+	fingerprint := ssh.FingerprintSHA256(key)
+	if host.HostKey == "" {
+		host.HostKey = fingerprint
+		return nil
+	}
+	if host.HostKey != fingerprint {
+		return fmt.Errorf("host key for %s changed: pinned %s, got %s", host.Address, host.HostKey, fingerprint)
+	}
+	return nil
+}
+
+// knownHostsPath returns the path to the current user's known_hosts file.
+func knownHostsPath() string {
+	return expandHome("~/.ssh/known_hosts")
+}
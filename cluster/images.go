@@ -0,0 +1,444 @@
+package cluster
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// Media types of the image manifests and manifest lists a registry is asked for.
+const (
+	mediaTypeOCIIndex       = "application/vnd.oci.image.index.v1+json"
+	mediaTypeDockerList     = "application/vnd.docker.distribution.manifest.list.v2+json"
+	mediaTypeOCIManifest    = "application/vnd.oci.image.manifest.v1+json"
+	mediaTypeDockerManifest = "application/vnd.docker.distribution.manifest.v2+json"
+)
+
+// imageFlags are the controller flags naming the images of the pods the controllers create, which
+// the controllers' manifests hold as arguments rather than as image fields.
+var imageFlags = []string{"--acme-http01-solver-image", "--prometheus-config-reloader"}
+
+// challengeParam matches a key="value" parameter of a WWW-Authenticate challenge.
+var challengeParam = regexp.MustCompile(`(\w+)="([^"]*)"`)
+
+// imageRef is a container image reference, normalized the way containerd names images.
+//
+// Fields:
+//   - registry: The registry host, e.g. docker.io or quay.io.
+//   - repository: The repository in the registry, e.g. library/postgres.
+//   - reference: The tag or digest of the image, e.g. 17-alpine or sha256:....
+type imageRef struct {
+	registry   string // Registry host.
+	repository string // Repository in the registry.
+	reference  string // Tag or digest.
+}
+
+// descriptor points at a blob of an image: its manifest, config or a layer.
+type descriptor struct {
+	MediaType string `json:"mediaType"`
+	Digest    string `json:"digest"`
+	Size      int64  `json:"size"`
+}
+
+// parseImageRef parses an image reference, defaulting to Docker Hub, its library namespace and the latest tag.
+//
+// Parameters:
+//   - image: The reference, e.g. postgres:17-alpine or quay.io/jetstack/cert-manager-controller:v1.17.2.
+//
+// Returns:
+//   - imageRef: The normalized reference.
+//   - error: An error if the reference has no repository.
+func parseImageRef(image string) (imageRef, error) {
+	ref := imageRef{registry: "docker.io"}
+	name := image
+	if at := strings.Index(name, "@"); at >= 0 {
+		name, ref.reference = name[:at], name[at+1:]
+	}
+	if colon := strings.LastIndex(name, ":"); colon > strings.LastIndex(name, "/") {
+		if ref.reference == "" {
+			ref.reference = name[colon+1:]
+		}
+		name = name[:colon]
+	}
+	if ref.reference == "" {
+		ref.reference = "latest"
+	}
+	if host, rest, ok := strings.Cut(name, "/"); ok && (strings.ContainsAny(host, ".:") || host == "localhost") {
+		ref.registry, name = host, rest
+	}
+	if ref.registry == "docker.io" && !strings.Contains(name, "/") {
+		name = "library/" + name
+	}
+	if name == "" {
+		return imageRef{}, fmt.Errorf("invalid image reference %q", image)
+	}
+	ref.repository = name
+	return ref, nil
+}
+
+// String returns the name containerd records the image under, e.g. docker.io/library/postgres:17-alpine.
+func (r imageRef) String() string {
+	if strings.Contains(r.reference, ":") {
+		return r.registry + "/" + r.repository + "@" + r.reference
+	}
+	return r.registry + "/" + r.repository + ":" + r.reference
+}
+
+// file returns the path in the air-gap bundle of the image's tarball.
+func (r imageRef) file() string {
+	return path.Join(bundleImages, strings.NewReplacer("/", "_", ":", "_", "@", "_").Replace(r.String())+".tar")
+}
+
+// imageRefs lists the images named by Kubernetes manifests: the values of image fields, and of the
+// controller flags in imageFlags.
+//
+// Parameters:
+//   - data: The manifests, as a stream of YAML or JSON documents.
+//
+// Returns:
+//   - []string: The image references, in the order they appear, with duplicates.
+//   - error: An error if the manifests are not valid YAML.
+func imageRefs(data []byte) ([]string, error) {
+	var images []string
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	for {
+		var doc any
+		err := decoder.Decode(&doc)
+		if err == io.EOF {
+			return images, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		collectImages(doc, &images)
+	}
+}
+
+// collectImages appends the images named in a decoded manifest to images.
+func collectImages(value any, images *[]string) {
+	switch v := value.(type) {
+	case map[string]any:
+		for key, item := range v {
+			if image, ok := item.(string); ok {
+				if key == "image" && image != "" {
+					*images = append(*images, image)
+				}
+				continue
+			}
+			collectImages(item, images)
+		}
+	case []any:
+		for _, item := range v {
+			if arg, ok := item.(string); ok {
+				if flag, image, ok := strings.Cut(arg, "="); ok && slices.Contains(imageFlags, flag) {
+					*images = append(*images, image)
+				}
+				continue
+			}
+			collectImages(item, images)
+		}
+	}
+}
+
+// pullImage downloads an image for the nodes' architecture from its registry into an OCI image
+// layout tarball, which k3s imports on start when it is placed in its images directory.
+//
+// Parameters:
+//   - ref: The image.
+//   - arch: The architecture of the nodes: amd64, arm64 or arm.
+//   - dest: The path of the tarball; its directory is created if missing.
+//
+// Returns:
+//   - error: An error if the registry refuses the pull, the image has no build for the architecture,
+//     a blob does not match its digest, or the tarball cannot be written.
+func pullImage(ref imageRef, arch, dest string) error {
+	registry := &registryClient{ref: ref}
+	manifest, mediaType, err := registry.manifest(ref.reference)
+	if err != nil {
+		return err
+	}
+	if mediaType == mediaTypeOCIIndex || mediaType == mediaTypeDockerList {
+		digest, err := platformManifest(manifest, arch)
+		if err != nil {
+			return fmt.Errorf("pull %s: %w", ref, err)
+		}
+		if manifest, mediaType, err = registry.manifest(digest); err != nil {
+			return err
+		}
+	}
+
+	reader, writer := io.Pipe()
+	defer reader.Close()
+	go func() {
+		writer.CloseWithError(registry.writeLayout(writer, manifest, mediaType))
+	}()
+	return writeDownload(reader, dest, ref.String())
+}
+
+// platformManifest picks the manifest of a Linux architecture from a manifest list.
+//
+// Parameters:
+//   - list: The manifest list or OCI index.
+//   - arch: The architecture of the nodes: amd64, arm64 or arm, which means ARMv7.
+//
+// Returns:
+//   - string: The digest of the manifest.
+//   - error: An error if the list cannot be decoded or has no manifest for the architecture.
+func platformManifest(list []byte, arch string) (string, error) {
+	var index struct {
+		Manifests []struct {
+			Digest   string `json:"digest"`
+			Platform struct {
+				OS           string `json:"os"`
+				Architecture string `json:"architecture"`
+				Variant      string `json:"variant"`
+			} `json:"platform"`
+		} `json:"manifests"`
+	}
+	if err := json.Unmarshal(list, &index); err != nil {
+		return "", err
+	}
+	for _, manifest := range index.Manifests {
+		platform := manifest.Platform
+		if platform.OS == "linux" && platform.Architecture == arch && (arch != "arm" || platform.Variant == "v7") {
+			return manifest.Digest, nil
+		}
+	}
+	return "", fmt.Errorf("no linux/%s image", arch)
+}
+
+// registryClient pulls the manifests and blobs of an image from its registry, with an anonymous
+// bearer token if the registry asks for one.
+type registryClient struct {
+	ref   imageRef // The image pulled.
+	token string   // Bearer token of the pull, once the registry asked for one.
+}
+
+// get requests a path of the image's repository, e.g. manifests/v1.0 or blobs/sha256:....
+//
+// Parameters:
+//   - p: The path, relative to the repository.
+//   - accept: The media types accepted, if any.
+//
+// Returns:
+//   - *http.Response: The response, with status 200 OK.
+//   - error: An error if the request fails or the registry refuses it.
+func (c *registryClient) get(p string, accept ...string) (*http.Response, error) {
+	host := c.ref.registry
+	if host == "docker.io" {
+		host = "registry-1.docker.io"
+	}
+	for {
+		req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("https://%s/v2/%s/%s", host, c.ref.repository, p), nil)
+		if err != nil {
+			return nil, err
+		}
+		if len(accept) > 0 {
+			req.Header.Set("Accept", strings.Join(accept, ", "))
+		}
+		if c.token != "" {
+			req.Header.Set("Authorization", "Bearer "+c.token)
+		}
+		resp, err := bundleClient.Do(req)
+		if err != nil {
+			return nil, fmt.Errorf("pull %s: %w", c.ref, err)
+		}
+		if resp.StatusCode == http.StatusUnauthorized && c.token == "" {
+			resp.Body.Close()
+			if err := c.authorize(resp.Header.Get("WWW-Authenticate")); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, fmt.Errorf("pull %s: %s: %s", c.ref, p, resp.Status)
+		}
+		return resp, nil
+	}
+}
+
+// authorize fetches an anonymous pull token from the realm of a bearer challenge.
+//
+// Parameters:
+//   - challenge: The WWW-Authenticate header of the registry's 401 response.
+//
+// Returns:
+//   - error: An error if the challenge is not a bearer one or the realm grants no token.
+func (c *registryClient) authorize(challenge string) error {
+	scheme, params, _ := strings.Cut(challenge, " ")
+	if !strings.EqualFold(scheme, "Bearer") {
+		return fmt.Errorf("pull %s: unsupported authentication %q", c.ref, challenge)
+	}
+	fields := map[string]string{}
+	for _, match := range challengeParam.FindAllStringSubmatch(params, -1) {
+		fields[match[1]] = match[2]
+	}
+	query := url.Values{"scope": {"repository:" + c.ref.repository + ":pull"}}
+	if service := fields["service"]; service != "" {
+		query.Set("service", service)
+	}
+	resp, err := bundleClient.Get(fields["realm"] + "?" + query.Encode())
+	if err != nil {
+		return fmt.Errorf("pull %s: %w", c.ref, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("pull %s: token: %s", c.ref, resp.Status)
+	}
+	var token struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return fmt.Errorf("pull %s: token: %w", c.ref, err)
+	}
+	c.token = token.Token
+	if c.token == "" {
+		c.token = token.AccessToken
+	}
+	if c.token == "" {
+		return fmt.Errorf("pull %s: the registry granted no token", c.ref)
+	}
+	return nil
+}
+
+// manifest fetches a manifest or manifest list of the image.
+//
+// Parameters:
+//   - reference: The tag or digest.
+//
+// Returns:
+//   - []byte: The manifest, as served, so that its digest holds.
+//   - string: Its media type.
+//   - error: An error if the manifest cannot be fetched.
+func (c *registryClient) manifest(reference string) ([]byte, string, error) {
+	resp, err := c.get("manifests/"+reference, mediaTypeOCIIndex, mediaTypeDockerList, mediaTypeOCIManifest, mediaTypeDockerManifest)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", fmt.Errorf("pull %s: %w", c.ref, err)
+	}
+	var manifest struct {
+		MediaType string `json:"mediaType"`
+	}
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, "", fmt.Errorf("pull %s: manifest: %w", c.ref, err)
+	}
+	if manifest.MediaType == "" {
+		manifest.MediaType, _, _ = strings.Cut(resp.Header.Get("Content-Type"), ";")
+	}
+	return data, manifest.MediaType, nil
+}
+
+// writeLayout writes an image as an OCI image layout tarball, streaming its config and layers from
+// the registry, and names it in index.json the way containerd imports it.
+//
+// Parameters:
+//   - w: The writer of the tarball.
+//   - manifest: The manifest of the image for the nodes' architecture.
+//   - mediaType: The media type of the manifest.
+//
+// Returns:
+//   - error: An error if a blob cannot be fetched, does not match its digest, or cannot be written.
+func (c *registryClient) writeLayout(w io.Writer, manifest []byte, mediaType string) error {
+	var image struct {
+		Config descriptor   `json:"config"`
+		Layers []descriptor `json:"layers"`
+	}
+	if err := json.Unmarshal(manifest, &image); err != nil {
+		return fmt.Errorf("pull %s: manifest: %w", c.ref, err)
+	}
+	sum := sha256.Sum256(manifest)
+	digest := "sha256:" + hex.EncodeToString(sum[:])
+	annotations := map[string]string{"io.containerd.image.name": c.ref.String()}
+	if !strings.Contains(c.ref.reference, ":") {
+		annotations["org.opencontainers.image.ref.name"] = c.ref.reference
+	}
+	index, err := json.Marshal(map[string]any{
+		"schemaVersion": 2,
+		"manifests": []any{map[string]any{
+			"mediaType":   mediaType,
+			"digest":      digest,
+			"size":        len(manifest),
+			"annotations": annotations,
+		}},
+	})
+	if err != nil {
+		return err
+	}
+
+	archive := tar.NewWriter(w)
+	for _, file := range []struct {
+		name string
+		data []byte
+	}{
+		{"oci-layout", []byte(`{"imageLayoutVersion":"1.0.0"}`)},
+		{"index.json", index},
+		{"blobs/sha256/" + hex.EncodeToString(sum[:]), manifest},
+	} {
+		if err := archive.WriteHeader(&tar.Header{Name: file.name, Mode: 0644, Size: int64(len(file.data))}); err != nil {
+			return err
+		}
+		if _, err := archive.Write(file.data); err != nil {
+			return err
+		}
+	}
+	written := map[string]bool{digest: true}
+	for _, blob := range append([]descriptor{image.Config}, image.Layers...) {
+		if written[blob.Digest] {
+			continue
+		}
+		if err := c.copyBlob(archive, blob); err != nil {
+			return err
+		}
+		written[blob.Digest] = true
+	}
+	return archive.Close()
+}
+
+// copyBlob streams a blob of the image into the tarball, checking its size and digest.
+//
+// Parameters:
+//   - archive: The tarball.
+//   - blob: The blob.
+//
+// Returns:
+//   - error: An error if the blob cannot be fetched or does not match its descriptor.
+func (c *registryClient) copyBlob(archive *tar.Writer, blob descriptor) error {
+	algorithm, sum, ok := strings.Cut(blob.Digest, ":")
+	if !ok || algorithm != "sha256" {
+		return fmt.Errorf("pull %s: unsupported digest %q", c.ref, blob.Digest)
+	}
+	resp, err := c.get("blobs/" + blob.Digest)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := archive.WriteHeader(&tar.Header{Name: "blobs/sha256/" + sum, Mode: 0644, Size: blob.Size}); err != nil {
+		return err
+	}
+	hash := sha256.New()
+	n, err := io.Copy(archive, io.TeeReader(resp.Body, hash))
+	if err != nil {
+		return fmt.Errorf("pull %s: %s: %w", c.ref, blob.Digest, err)
+	}
+	if n != blob.Size || hex.EncodeToString(hash.Sum(nil)) != sum {
+		return fmt.Errorf("pull %s: blob %s does not match its digest", c.ref, blob.Digest)
+	}
+	return nil
+}
@@ -0,0 +1,289 @@
+package cluster
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeRegistry is a registry v2 server holding multi-arch images, which grants an anonymous bearer
+// token for pulls and refuses requests without it.
+type fakeRegistry struct {
+	blobs   map[string][]byte // Manifests and blobs, keyed by digest.
+	types   map[string]string // Media types of the manifests, keyed by digest.
+	tags    map[string]string // Digests of the tagged manifests, keyed by repository:tag.
+	corrupt map[string]bool   // Blobs served with content that does not match their digest.
+
+	mu     sync.Mutex
+	tokens []string // Scopes of the tokens granted, in order.
+}
+
+// newFakeRegistry creates an empty fakeRegistry.
+func newFakeRegistry() *fakeRegistry {
+	return &fakeRegistry{
+		blobs:   map[string][]byte{},
+		types:   map[string]string{},
+		tags:    map[string]string{},
+		corrupt: map[string]bool{},
+	}
+}
+
+// add stores a blob and returns its descriptor.
+func (r *fakeRegistry) add(mediaType string, data []byte) descriptor {
+	sum := sha256.Sum256(data)
+	digest := "sha256:" + hex.EncodeToString(sum[:])
+	r.blobs[digest] = data
+	r.types[digest] = mediaType
+	return descriptor{MediaType: mediaType, Digest: digest, Size: int64(len(data))}
+}
+
+// addImage stores an image with a build for each platform, given as os/arch[/variant], under an OCI
+// index tagged in a repository. The single layer of each build holds the name of its platform.
+func (r *fakeRegistry) addImage(repository, tag string, platforms ...string) {
+	var manifests []map[string]any
+	for _, platform := range platforms {
+		parts := strings.Split(platform, "/")
+		config := r.add("application/vnd.oci.image.config.v1+json", []byte(fmt.Sprintf(`{"architecture":%q}`, parts[1])))
+		layer := r.add("application/vnd.oci.image.layer.v1.tar", []byte(platform))
+		manifest, _ := json.Marshal(map[string]any{
+			"schemaVersion": 2,
+			"mediaType":     mediaTypeOCIManifest,
+			"config":        config,
+			"layers":        []descriptor{layer},
+		})
+		desc := r.add(mediaTypeOCIManifest, manifest)
+		target := map[string]string{"os": parts[0], "architecture": parts[1]}
+		if len(parts) > 2 {
+			target["variant"] = parts[2]
+		}
+		manifests = append(manifests, map[string]any{"mediaType": desc.MediaType, "digest": desc.Digest, "size": desc.Size, "platform": target})
+	}
+	index, _ := json.Marshal(map[string]any{"schemaVersion": 2, "mediaType": mediaTypeOCIIndex, "manifests": manifests})
+	r.tags[repository+":"+tag] = r.add(mediaTypeOCIIndex, index).Digest
+}
+
+// layer returns the digest of the layer holding a platform's name.
+func (r *fakeRegistry) layer(platform string) string {
+	sum := sha256.Sum256([]byte(platform))
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// ServeHTTP serves the token realm at /token and the manifests and blobs under /v2/.
+func (r *fakeRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path == "/token" {
+		if req.URL.Query().Get("service") != "fake-registry" {
+			http.Error(w, "unknown service", http.StatusForbidden)
+			return
+		}
+		r.mu.Lock()
+		r.tokens = append(r.tokens, req.URL.Query().Get("scope"))
+		r.mu.Unlock()
+		_, _ = w.Write([]byte(`{"token":"pull-token"}`))
+		return
+	}
+	rest, ok := strings.CutPrefix(req.URL.Path, "/v2/")
+	if !ok {
+		http.NotFound(w, req)
+		return
+	}
+	if req.Header.Get("Authorization") != "Bearer pull-token" {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="https://%s/token",service="fake-registry"`, req.Host))
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if repository, reference, ok := strings.Cut(rest, "/manifests/"); ok {
+		digest := reference
+		if !strings.HasPrefix(reference, "sha256:") {
+			digest = r.tags[repository+":"+reference]
+		}
+		data, ok := r.blobs[digest]
+		if !ok {
+			http.NotFound(w, req)
+			return
+		}
+		w.Header().Set("Content-Type", r.types[digest])
+		_, _ = w.Write(data)
+		return
+	}
+	if _, digest, ok := strings.Cut(rest, "/blobs/"); ok {
+		data, ok := r.blobs[digest]
+		if !ok {
+			http.NotFound(w, req)
+			return
+		}
+		if r.corrupt[digest] {
+			data = append([]byte("x"), data[1:]...)
+		}
+		_, _ = w.Write(data)
+		return
+	}
+	http.NotFound(w, req)
+}
+
+// serveRegistry starts a TLS server for a registry and points bundleClient at it for the test.
+//
+// Returns:
+//   - string: The host of the registry, used as the registry of image references.
+func serveRegistry(t *testing.T, handler http.Handler) string {
+	t.Helper()
+	server := httptest.NewTLSServer(handler)
+	t.Cleanup(server.Close)
+	previous := bundleClient
+	bundleClient = server.Client()
+	t.Cleanup(func() { bundleClient = previous })
+	return strings.TrimPrefix(server.URL, "https://")
+}
+
+// readLayout reads the files of an OCI image layout tarball, keyed by name.
+func readLayout(t *testing.T, file string) map[string][]byte {
+	t.Helper()
+	f, err := os.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	files := map[string][]byte{}
+	archive := tar.NewReader(f)
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			return files
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if files[header.Name], err = io.ReadAll(archive); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestParseImageRef(t *testing.T) {
+	tests := []struct {
+		image string
+		want  string
+		file  string
+	}{
+		{"postgres", "docker.io/library/postgres:latest", "images/docker.io_library_postgres_latest.tar"},
+		{"postgres:17-alpine", "docker.io/library/postgres:17-alpine", "images/docker.io_library_postgres_17-alpine.tar"},
+		{"gitea/gitea:1.23", "docker.io/gitea/gitea:1.23", "images/docker.io_gitea_gitea_1.23.tar"},
+		{"quay.io/jetstack/cert-manager-controller:v1.17.2", "quay.io/jetstack/cert-manager-controller:v1.17.2", "images/quay.io_jetstack_cert-manager-controller_v1.17.2.tar"},
+		{"localhost:5000/app", "localhost:5000/app:latest", "images/localhost_5000_app_latest.tar"},
+		{"ghcr.io/org/app:v1@sha256:abc", "ghcr.io/org/app@sha256:abc", "images/ghcr.io_org_app_sha256_abc.tar"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.image, func(t *testing.T) {
+			ref, err := parseImageRef(tt.image)
+			if err != nil {
+				t.Fatalf("parseImageRef: %v", err)
+			}
+			if got := ref.String(); got != tt.want {
+				t.Errorf("String() = %q, want %q", got, tt.want)
+			}
+			if got := ref.file(); got != tt.file {
+				t.Errorf("file() = %q, want %q", got, tt.file)
+			}
+		})
+	}
+}
+
+func TestPullImage(t *testing.T) {
+	registry := newFakeRegistry()
+	registry.addImage("team/app", "v1", "linux/amd64", "linux/arm64", "linux/arm/v6", "linux/arm/v7", "windows/amd64")
+	host := serveRegistry(t, registry)
+
+	tests := []struct {
+		name     string
+		arch     string
+		platform string
+		err      string
+	}{
+		{"amd64 build", "amd64", "linux/amd64", ""},
+		{"arm64 build", "arm64", "linux/arm64", ""},
+		{"arm means ARMv7", "arm", "linux/arm/v7", ""},
+		{"no build for the architecture", "s390x", "", "no linux/s390x image"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ref, err := parseImageRef(host + "/team/app:v1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			dest := filepath.Join(t.TempDir(), ref.file())
+			err = pullImage(ref, tt.arch, dest)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("pullImage = %v, want an error containing %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("pullImage: %v", err)
+			}
+
+			files := readLayout(t, dest)
+			layer, _ := strings.CutPrefix(registry.layer(tt.platform), "sha256:")
+			if got := string(files["blobs/sha256/"+layer]); got != tt.platform {
+				t.Errorf("layer = %q, want the %s build", got, tt.platform)
+			}
+			var index struct {
+				Manifests []struct {
+					Digest      string            `json:"digest"`
+					Annotations map[string]string `json:"annotations"`
+				} `json:"manifests"`
+			}
+			if err := json.Unmarshal(files["index.json"], &index); err != nil || len(index.Manifests) != 1 {
+				t.Fatalf("index.json = %s, %v", files["index.json"], err)
+			}
+			manifest := index.Manifests[0]
+			if got := manifest.Annotations["io.containerd.image.name"]; got != ref.String() {
+				t.Errorf("image name = %q, want %q", got, ref.String())
+			}
+			digest, _ := strings.CutPrefix(manifest.Digest, "sha256:")
+			if _, ok := files["blobs/sha256/"+digest]; !ok {
+				t.Errorf("the manifest %s named by index.json is not in the layout", manifest.Digest)
+			}
+		})
+	}
+
+	for _, scope := range registry.tokens {
+		if scope != "repository:team/app:pull" {
+			t.Errorf("token scope = %q, want repository:team/app:pull", scope)
+		}
+	}
+	if got := len(registry.tokens); got != len(tests) {
+		t.Errorf("granted %d tokens, want one per pull", got)
+	}
+}
+
+func TestPullImageDigestMismatch(t *testing.T) {
+	registry := newFakeRegistry()
+	registry.addImage("team/app", "v1", "linux/amd64")
+	registry.corrupt[registry.layer("linux/amd64")] = true
+	host := serveRegistry(t, registry)
+
+	ref, err := parseImageRef(host + "/team/app:v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dest := filepath.Join(t.TempDir(), ref.file())
+	err = pullImage(ref, "amd64", dest)
+	if err == nil || !strings.Contains(err.Error(), "does not match its digest") {
+		t.Fatalf("pullImage = %v, want a digest mismatch", err)
+	}
+	for _, file := range []string{dest, dest + ".tmp"} {
+		if _, err := os.Stat(file); !os.IsNotExist(err) {
+			t.Errorf("%s was left behind", filepath.Base(file))
+		}
+	}
+}
@@ -0,0 +1,276 @@
+package cluster
+
+import (
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"maps"
+	"path"
+	"slices"
+)
+
+// Paths of the k3s config file on a node and of its upload before it is moved into place.
+const (
+	k3sConfigPath   = "/etc/rancher/k3s/config.yaml"
+	k3sConfigUpload = "/tmp/k3sd/config.yaml"
+)
+
+// AgentConfig holds the k3s options of a node, written to its /etc/rancher/k3s/config.yaml. On a
+// worker they configure its agent; on a cluster they are the defaults of its workers, each field
+// overridden by the worker's own agent block.
+//
+// Fields:
+//   - NodeIP: The IP address advertised for the node (node-ip).
+//   - NodeExternalIP: The external IP address advertised for the node (node-external-ip).
+//   - NodeLabel: Labels registered with the node, as k=v (node-label).
+//   - NodeTaint: Taints registered with the node, as k=v:effect (node-taint).
+//   - KubeletArg: Extra kubelet flags, as flag=value (kubelet-arg).
+//   - KubeProxyArg: Extra kube-proxy flags, as flag=value (kube-proxy-arg).
+//   - Extra: Any other k3s option, keyed by its config file name, e.g. "protect-kernel-defaults".
+type AgentConfig struct {
+	NodeIP         string         `json:"nodeIp,omitempty"`         // node-ip.
+	NodeExternalIP string         `json:"nodeExternalIp,omitempty"` // node-external-ip.
+	NodeLabel      []string       `json:"nodeLabel,omitempty"`      // node-label.
+	NodeTaint      []string       `json:"nodeTaint,omitempty"`      // node-taint.
+	KubeletArg     []string       `json:"kubeletArg,omitempty"`     // kubelet-arg.
+	KubeProxyArg   []string       `json:"kubeProxyArg,omitempty"`   // kube-proxy-arg.
+	Extra          map[string]any `json:"extra,omitempty"`          // Other options, keyed by config file name.
+}
+
+// ServerConfig holds the k3s options of a cluster's server, written to its /etc/rancher/k3s/config.yaml.
+// It accepts the agent options too, which apply to the server's own node.
+//
+// Fields:
+//   - AgentConfig: The options of the server's own node.
+//   - TLSSAN: Extra host names and IP addresses of the API server certificate (tls-san).
+//   - ClusterCIDR: The pod network (cluster-cidr).
+//   - ServiceCIDR: The service network (service-cidr).
+//   - ClusterDNS: The cluster DNS service IP address (cluster-dns).
+//   - ClusterDomain: The cluster domain (cluster-domain).
+//   - Disable: Packaged components not deployed (disable); traefik is always disabled, as k3sd installs its own.
+//   - FlannelBackend: The flannel backend, or none (flannel-backend).
+//   - KubeAPIServerArg: Extra kube-apiserver flags, as flag=value (kube-apiserver-arg).
+type ServerConfig struct {
+	AgentConfig               // Embeds the options of the server's own node.
+	TLSSAN           []string `json:"tlsSan,omitempty"`           // tls-san.
+	ClusterCIDR      string   `json:"clusterCidr,omitempty"`      // cluster-cidr.
+	ServiceCIDR      string   `json:"serviceCidr,omitempty"`      // service-cidr.
+	ClusterDNS       string   `json:"clusterDns,omitempty"`       // cluster-dns.
+	ClusterDomain    string   `json:"clusterDomain,omitempty"`    // cluster-domain.
+	Disable          []string `json:"disable,omitempty"`          // disable.
+	FlannelBackend   string   `json:"flannelBackend,omitempty"`   // flannel-backend.
+	KubeAPIServerArg []string `json:"kubeApiserverArg,omitempty"` // kube-apiserver-arg.
+}
+
+// options returns the agent options keyed by their k3s config file names, leaving out unset ones.
+func (c AgentConfig) options() map[string]any {
+	options := map[string]any{}
+	setOption(options, "node-ip", c.NodeIP)
+	setOption(options, "node-external-ip", c.NodeExternalIP)
+	setOption(options, "node-label", c.NodeLabel)
+	setOption(options, "node-taint", c.NodeTaint)
+	setOption(options, "kubelet-arg", c.KubeletArg)
+	setOption(options, "kube-proxy-arg", c.KubeProxyArg)
+	return options
+}
+
+// options returns the server options keyed by their k3s config file names, leaving out unset ones.
+func (c ServerConfig) options() map[string]any {
+	options := c.AgentConfig.options()
+	setOption(options, "tls-san", c.TLSSAN)
+	setOption(options, "cluster-cidr", c.ClusterCIDR)
+	setOption(options, "service-cidr", c.ServiceCIDR)
+	setOption(options, "cluster-dns", c.ClusterDNS)
+	setOption(options, "cluster-domain", c.ClusterDomain)
+	setOption(options, "disable", c.Disable)
+	setOption(options, "flannel-backend", c.FlannelBackend)
+	setOption(options, "kube-apiserver-arg", c.KubeAPIServerArg)
+	return options
+}
+
+// setOption sets a k3s option unless its value is empty.
+func setOption[T string | []string](options map[string]any, name string, value T) {
+	if len(value) > 0 {
+		options[name] = value
+	}
+}
+
+// mergeAgentConfig overlays a worker's agent options onto its cluster's defaults.
+//
+// Parameters:
+//   - defaults: The agent block of the cluster.
+//   - node: The agent block of the worker; its set fields and extra options win.
+//
+// Returns:
+//   - AgentConfig: The merged options.
+func mergeAgentConfig(defaults, node AgentConfig) AgentConfig {
+	merged := defaults
+	if node.NodeIP != "" {
+		merged.NodeIP = node.NodeIP
+	}
+	if node.NodeExternalIP != "" {
+		merged.NodeExternalIP = node.NodeExternalIP
+	}
+	if node.NodeLabel != nil {
+		merged.NodeLabel = node.NodeLabel
+	}
+	if node.NodeTaint != nil {
+		merged.NodeTaint = node.NodeTaint
+	}
+	if node.KubeletArg != nil {
+		merged.KubeletArg = node.KubeletArg
+	}
+	if node.KubeProxyArg != nil {
+		merged.KubeProxyArg = node.KubeProxyArg
+	}
+	merged.Extra = maps.Clone(defaults.Extra)
+	if merged.Extra == nil {
+		merged.Extra = map[string]any{}
+	}
+	maps.Copy(merged.Extra, node.Extra)
+	return merged
+}
+
+// renderK3sConfig renders k3s options as a config file.
+//
+// Parameters:
+//   - options: The modelled options, keyed by config file name.
+//   - extra: The extra options, which must not repeat a modelled one.
+//
+// Returns:
+//   - []byte: The config file, with its keys sorted.
+//   - error: An error if an extra option repeats a modelled one or cannot be encoded.
+func renderK3sConfig(options, extra map[string]any) ([]byte, error) {
+	if err := extraOptionConflicts(options, extra); err != nil {
+		return nil, err
+	}
+	all := maps.Clone(options)
+	maps.Copy(all, extra)
+	return yaml.Marshal(all)
+}
+
+// extraOptionConflicts checks that extra options do not repeat the modelled ones.
+//
+// Parameters:
+//   - options: The modelled options that are set, keyed by config file name.
+//   - extra: The extra options.
+//
+// Returns:
+//   - error: An error naming the repeated options, or nil.
+func extraOptionConflicts(options, extra map[string]any) error {
+	var repeated []string
+	for name := range extra {
+		if _, ok := options[name]; ok {
+			repeated = append(repeated, name)
+		}
+	}
+	if len(repeated) > 0 {
+		slices.Sort(repeated)
+		return fmt.Errorf("extra repeats %v, which is already set by its own field", repeated)
+	}
+	return nil
+}
+
+// serverK3sConfig renders the config file of a cluster's first server, which initialises embedded etcd
+// when the cluster has additional servers and no external datastore.
+//
+// Parameters:
+//   - cluster: The cluster.
+//
+// Returns:
+//   - []byte: The config file.
+//   - error: An error if the options cannot be rendered.
+func serverK3sConfig(cluster Cluster) ([]byte, error) {
+	return renderServerConfig(cluster, cluster.Server, cluster.embeddedEtcd())
+}
+
+// joinedServerK3sConfig renders the config file of an additional server, sharing the cluster's server
+// options with the agent options of its own node.
+//
+// Parameters:
+//   - cluster: The cluster.
+//   - server: The additional server.
+//
+// Returns:
+//   - []byte: The config file.
+//   - error: An error if the options cannot be rendered.
+func joinedServerK3sConfig(cluster Cluster, server Worker) ([]byte, error) {
+	config := cluster.Server
+	config.AgentConfig = mergeAgentConfig(config.AgentConfig, server.Agent)
+	return renderServerConfig(cluster, config, false)
+}
+
+// renderServerConfig renders the config file of a server.
+//
+// Parameters:
+//   - cluster: The cluster.
+//   - server: The server options.
+//   - clusterInit: Whether the server initialises embedded etcd (cluster-init).
+//
+// Returns:
+//   - []byte: The config file.
+//   - error: An error if the options cannot be rendered.
+func renderServerConfig(cluster Cluster, server ServerConfig, clusterInit bool) ([]byte, error) {
+	return renderK3sConfig(serverOptions(cluster, server, clusterInit), server.Extra)
+}
+
+// serverOptions returns the modelled options of a server. Traefik is always disabled, as k3sd installs
+// its own, the registration address is added to the API server certificate and the datastore options
+// point at the uploaded TLS files.
+//
+// Parameters:
+//   - cluster: The cluster.
+//   - server: The server options.
+//   - clusterInit: Whether the server initialises embedded etcd (cluster-init).
+//
+// Returns:
+//   - map[string]any: The options, keyed by config file name.
+func serverOptions(cluster Cluster, server ServerConfig, clusterInit bool) map[string]any {
+	if !slices.Contains(server.Disable, "traefik") {
+		server.Disable = append(slices.Clone(server.Disable), "traefik")
+	}
+	if cluster.RegistrationAddress != "" && !slices.Contains(server.TLSSAN, cluster.RegistrationAddress) {
+		server.TLSSAN = append(slices.Clone(server.TLSSAN), cluster.RegistrationAddress)
+	}
+	options := server.options()
+	maps.Copy(options, cluster.Datastore.options())
+	if clusterInit {
+		options["cluster-init"] = true
+	}
+	return options
+}
+
+// agentK3sConfig renders the config file of a worker's agent.
+//
+// Parameters:
+//   - cluster: The cluster, whose agent block holds the defaults.
+//   - worker: The worker.
+//
+// Returns:
+//   - []byte: The config file.
+//   - error: An error if the options cannot be rendered.
+func agentK3sConfig(cluster Cluster, worker Worker) ([]byte, error) {
+	agent := mergeAgentConfig(cluster.Agent, worker.Agent)
+	return renderK3sConfig(agent.options(), agent.Extra)
+}
+
+// k3sConfigStep returns the step uploading a node's k3s config file before k3s is installed.
+//
+// Parameters:
+//   - client: The Executor for the node.
+//   - render: Renders the config file.
+//
+// Returns:
+//   - step: The "k3s-config" step.
+func k3sConfigStep(client Executor, render func() ([]byte, error)) step {
+	return step{name: "k3s-config", run: func() error {
+		config, err := render()
+		if err != nil {
+			return err
+		}
+		// The config can hold credentials, so only root may read it once in place.
+		if err := client.Upload(k3sConfigUpload, config, 0600); err != nil {
+			return err
+		}
+		return client.Run(fmt.Sprintf("sudo mkdir -p %s && sudo install -m 0600 %s %s && rm -f %s", path.Dir(k3sConfigPath), k3sConfigUpload, k3sConfigPath, k3sConfigUpload))
+	}}
+}
@@ -0,0 +1,139 @@
+package cluster
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/argon-chat/k3sd/yamls"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+// manifestsDir is the directory on the master node that embedded manifests are uploaded to.
+const manifestsDir = "/tmp/yamls"
+
+// templateSuffix marks an embedded manifest as a Go template rendered against the cluster.
+const templateSuffix = ".tmpl"
+
+// manifestFuncs are the functions available to manifest templates besides the text/template builtins.
+var manifestFuncs = template.FuncMap{
+	// quote renders a string as a double-quoted YAML scalar, so passwords and names may hold any character.
+	"quote": func(s string) (string, error) {
+		quoted, err := json.Marshal(s)
+		return string(quoted), err
+	},
+	// required fails the render when a config field the manifest needs is empty.
+	"required": func(field, value string) (string, error) {
+		if value == "" {
+			return "", fmt.Errorf("%s is required", field)
+		}
+		return value, nil
+	},
+}
+
+// renderedManifest is an embedded manifest rendered for a cluster.
+//
+// Fields:
+//   - Name: The file name of the manifest, without the template suffix.
+//   - Data: The rendered manifest.
+type renderedManifest struct {
+	Name string // File name of the manifest.
+	Data []byte // Rendered manifest.
+}
+
+// manifestRenderer is implemented by addons that apply embedded manifests, so they can be
+// rendered before deployment to surface template errors and for review.
+type manifestRenderer interface {
+	// renderManifests renders the addon's manifests for a cluster.
+	renderManifests(cluster Cluster) ([]renderedManifest, error)
+}
+
+// renderManifest reads an embedded manifest and, if its name ends in .tmpl, renders it as a Go
+// template against the cluster. Referencing a field or map key that does not exist is an error.
+//
+// Parameters:
+//   - name: The file name of the manifest in the yamls directory.
+//   - cluster: The cluster the manifest is rendered for.
+//
+// Returns:
+//   - renderedManifest: The rendered manifest, named without the template suffix.
+//   - error: An error if there is no such manifest or it fails to render.
+func renderManifest(name string, cluster Cluster) (renderedManifest, error) {
+	data, err := yamls.FS.ReadFile(name)
+	if err != nil {
+		return renderedManifest{}, fmt.Errorf("read embedded manifest: %w", err)
+	}
+	if !strings.HasSuffix(name, templateSuffix) {
+		return renderedManifest{Name: name, Data: data}, nil
+	}
+
+	tmpl, err := template.New(name).Option("missingkey=error").Funcs(manifestFuncs).Parse(string(data))
+	if err != nil {
+		return renderedManifest{}, err
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, cluster); err != nil {
+		return renderedManifest{}, err
+	}
+	return renderedManifest{Name: strings.TrimSuffix(name, templateSuffix), Data: buf.Bytes()}, nil
+}
+
+// uploadManifests uploads rendered manifests to the master node.
+//
+// Parameters:
+//   - master: The Executor for the master node.
+//   - manifests: The rendered manifests.
+//
+// Returns:
+//   - error: An error if a manifest cannot be uploaded.
+func uploadManifests(master Executor, manifests []renderedManifest) error {
+	for _, manifest := range manifests {
+		// Rendered manifests can hold credentials, so only the SSH user may read them.
+		if err := master.Upload(path.Join(manifestsDir, manifest.Name), manifest.Data, 0600); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RenderManifests renders the embedded manifests of every addon enabled on each cluster and writes
+// them to dir/<nodeName>/ for review, without connecting to any host. The files are written with
+// mode 0600, as they can hold credentials.
+//
+// Parameters:
+//   - dir: The directory to write the manifests to, created if missing.
+//   - clusters: The clusters to render the manifests of.
+//
+// Returns:
+//   - error: An error if the addons cannot be resolved, a manifest fails to render, or a file cannot be written.
+func RenderManifests(dir string, clusters []Cluster) error {
+	for _, cluster := range clusters {
+		addons, err := clusterAddons(cluster)
+		if err != nil {
+			return fmt.Errorf("%s: %w", cluster.NodeName, err)
+		}
+		clusterDir := filepath.Join(dir, cluster.NodeName)
+		for _, addon := range addons {
+			renderer, ok := addon.(manifestRenderer)
+			if !ok {
+				continue
+			}
+			manifests, err := renderer.renderManifests(cluster)
+			if err != nil {
+				return fmt.Errorf("%s: %s addon: %w", cluster.NodeName, addon.Name(), err)
+			}
+			if err := os.MkdirAll(clusterDir, 0700); err != nil {
+				return err
+			}
+			for _, manifest := range manifests {
+				if err := os.WriteFile(filepath.Join(clusterDir, manifest.Name), manifest.Data, 0600); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
@@ -1,34 +1,132 @@
 package cluster
 
+import "time"
+
 // Cluster represents a cluster configuration, including its domain and associated workers.
 //
 // Fields:
 //   - Domain: The domain name associated with the cluster.
+//   - K3sVersion: The k3s release installed on every node, e.g. v1.32.3+k3s1; takes precedence over K3sChannel.
+//   - K3sChannel: The k3s release channel installed from, e.g. stable or v1.31; the install script's default if empty.
 //   - Gitea: A Gitea configuration object containing PostgreSQL credentials.
 //   - Workers: A slice of Worker objects representing the workers in the cluster.
+//   - Servers: The additional servers joined to the cluster's own node, its first server, over embedded etcd or the datastore.
+//   - RegistrationAddress: The fixed address of the servers, e.g. a VIP or load balancer, used by agents and the kubeconfig.
+//   - Addons: The addons selected for the cluster, keyed by addon name, overriding the CLI flags.
+//   - ExtraAddons: Helm charts and manifest directories declared as addons of the cluster.
+//   - Server: The k3s options of the server, written to its /etc/rancher/k3s/config.yaml.
+//   - Datastore: The external datastore of the servers, used instead of embedded etcd if its endpoint is set.
+//   - Kubeconfig: The path of the kubeconfig saved for the cluster, kept in the state file.
 type Cluster struct {
-	Worker           // Embeds the Worker struct, inheriting its fields and methods.
-	Domain  string   `json:"domain"`  // The domain name associated with the cluster.
-	Gitea   Gitea    `json:"gitea"`   // Gitea configuration for the cluster.
-	Workers []Worker `json:"workers"` // List of worker nodes in the cluster.
+	Worker                                     // Embeds the Worker struct, inheriting its fields and methods.
+	Domain              string                 `json:"domain"`                        // The domain name associated with the cluster.
+	K3sVersion          string                 `json:"k3sVersion,omitempty"`          // k3s release installed on every node.
+	K3sChannel          string                 `json:"k3sChannel,omitempty"`          // k3s release channel installed from.
+	Gitea               Gitea                  `json:"gitea"`                         // Gitea configuration for the cluster.
+	Workers             []Worker               `json:"workers"`                       // List of worker nodes in the cluster.
+	Servers             []Worker               `json:"servers,omitempty"`             // Additional servers joined to the first.
+	RegistrationAddress string                 `json:"registrationAddress,omitempty"` // Fixed address of the servers.
+	Addons              map[string]AddonConfig `json:"addons,omitempty"`              // Addons selected for the cluster, keyed by addon name.
+	ExtraAddons         []ExtraAddon           `json:"extraAddons,omitempty"`         // Helm charts and manifest directories declared as addons.
+	Server              ServerConfig           `json:"server,omitempty"`              // k3s options of the server.
+	Datastore           Datastore              `json:"datastore,omitempty"`           // External datastore of the servers.
+	Kubeconfig          string                 `json:"-"`                             // Path of the saved kubeconfig, kept in the state file.
 }
 
 // Worker represents a worker node in the cluster.
 //
 // Fields:
-//   - Address: The IP address or hostname of the worker node.
-//   - User: The username used to connect to the worker node.
-//   - Password: The password used to authenticate the connection to the worker node.
+//   - Host: The address, credentials and pinned host key used to reach the node.
+//   - Jump: The bastion hosts to hop through, in order, to reach the node.
 //   - NodeName: The name of the node in the cluster.
 //   - Labels: The labels assigned to the node for identification or grouping.
-//   - Done: A boolean indicating whether the worker setup is complete.
+//   - Agent: The k3s options of the worker's agent; on an additional server, those of its own node;
+//     on a cluster, the defaults of its workers.
+//   - Done: A boolean indicating whether the worker setup is complete, kept in the state file.
+//   - Steps: The outcome of each named provisioning step, keyed by step name, kept in the state file.
+//   - InstalledVersion: The k3s version found on the node after install, kept in the state file.
 type Worker struct {
-	Address  string `json:"address"`  // IP address or hostname of the worker node.
-	User     string `json:"user"`     // Username for connecting to the worker node.
-	Password string `json:"password"` // Password for authenticating the connection.
-	NodeName string `json:"nodeName"` // Name of the node in the cluster.
-	Labels   string `json:"labels"`   // Labels for identification or grouping.
-	Done     bool   `json:"done"`     // Indicates if the worker setup is complete.
+	Host                                  // Embeds the Host struct, inheriting its fields.
+	Jump             []Host               `json:"jump,omitempty"`  // Bastion hosts to hop through, in order.
+	NodeName         string               `json:"nodeName"`        // Name of the node in the cluster.
+	Labels           string               `json:"labels"`          // Labels for identification or grouping.
+	Agent            AgentConfig          `json:"agent,omitempty"` // k3s options of the agent; on a cluster, the workers' defaults.
+	Done             bool                 `json:"done,omitempty"`  // Indicates if the worker setup is complete; read from older configs.
+	Steps            map[string]StepState `json:"-"`               // Outcome of each provisioning step.
+	InstalledVersion string               `json:"-"`               // k3s version found on the node after install.
+}
+
+// StepState records the outcome of a provisioning step on a node.
+//
+// Fields:
+//   - Status: Either StepDone or StepFailed.
+//   - Time: The time the step finished, in UTC.
+//   - Error: The error message if the step failed.
+type StepState struct {
+	Status string    `json:"status"`          // Either StepDone or StepFailed.
+	Time   time.Time `json:"time"`            // Time the step finished, in UTC.
+	Error  string    `json:"error,omitempty"` // Error message if the step failed.
+}
+
+// Host represents an SSH endpoint, either a cluster node or a bastion used to reach one.
+//
+// Fields:
+//   - Address: The IP address or hostname of the host.
+//   - User: The username used to connect to the host.
+//   - Password: The password used to authenticate the connection to the host.
+//   - KeyPath: The path to a private key used to authenticate the connection to the host.
+//   - KeyPassphrase: The passphrase protecting the private key, if it is encrypted.
+//   - HostKey: The SHA256 fingerprint of the host key pinned on first connect, kept in the state file.
+//   - Port: The SSH port of the host, 22 if unset.
+//   - ConnectTimeout: The timeout for dialing and the SSH handshake, e.g. "10s".
+//   - KeepaliveInterval: The interval between SSH keepalive requests, e.g. "30s".
+type Host struct {
+	Address           string `json:"address"`                     // IP address or hostname of the host.
+	User              string `json:"user"`                        // Username for connecting to the host.
+	Password          string `json:"password,omitempty"`          // Password for authenticating the connection.
+	KeyPath           string `json:"keyPath,omitempty"`           // Path to a private key for authenticating the connection.
+	KeyPassphrase     string `json:"keyPassphrase,omitempty"`     // Passphrase for the private key, if it is encrypted.
+	HostKey           string `json:"hostKey,omitempty"`           // Pinned SHA256 fingerprint of the host key.
+	Port              int    `json:"port,omitempty"`              // SSH port, 22 if unset.
+	ConnectTimeout    string `json:"connectTimeout,omitempty"`    // Dial and handshake timeout, 15s if unset.
+	KeepaliveInterval string `json:"keepaliveInterval,omitempty"` // Keepalive interval, 30s if unset.
+}
+
+// WorkerJump returns the bastion hosts used to reach a worker node.
+// Workers without their own jump hosts inherit the cluster's.
+//
+// Parameters:
+//   - worker: The Worker to reach.
+//
+// Returns:
+//   - []Host: The bastion hosts to hop through, in order.
+func (c Cluster) WorkerJump(worker Worker) []Host {
+	if len(worker.Jump) > 0 {
+		return worker.Jump
+	}
+	return c.Jump
+}
+
+// highlyAvailable reports whether the cluster runs several servers.
+func (c Cluster) highlyAvailable() bool {
+	return len(c.Servers) > 0
+}
+
+// embeddedEtcd reports whether the servers share embedded etcd, initialised by the first one,
+// rather than an external datastore.
+func (c Cluster) embeddedEtcd() bool {
+	return c.highlyAvailable() && !c.Datastore.external()
+}
+
+// apiAddress returns the address agents register with and the kubeconfig points at.
+//
+// Returns:
+//   - string: The registration address if set, otherwise the address of the first server.
+func (c Cluster) apiAddress() string {
+	if c.RegistrationAddress != "" {
+		return c.RegistrationAddress
+	}
+	return c.Address
 }
 
 // Gitea represents the Gitea configuration for the cluster.
@@ -0,0 +1,44 @@
+package cluster
+
+import (
+	"errors"
+	"sync"
+)
+
+// forEachParallel calls fn for every index in [0, count), running at most limit calls at once.
+// Every index is processed even if some calls fail.
+//
+// Parameters:
+//   - count: The number of indices to process.
+//   - limit: The maximum number of concurrent calls; values below 1 run sequentially.
+//   - fn: The function to call for each index.
+//
+// Returns:
+//   - error: The joined errors of every failed call, or nil if all succeed.
+func forEachParallel(count, limit int, fn func(i int) error) error {
+	if limit < 1 {
+		limit = 1
+	}
+
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		errs []error
+	)
+	slots := make(chan struct{}, limit)
+	for i := 0; i < count; i++ {
+		slots <- struct{}{}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			if err := fn(i); err != nil {
+				mu.Lock()
+				errs = append(errs, err)
+				mu.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
@@ -0,0 +1,201 @@
+package cluster
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/argon-chat/k3sd/utils"
+	"gopkg.in/yaml.v3"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// Prefixes of secret references accepted in place of plaintext passwords.
+const (
+	secretEnvPrefix  = "env:"  // env:NAME reads an environment variable.
+	secretFilePrefix = "file:" // file:/path reads a file, without its trailing newline.
+	secretCmdPrefix  = "cmd:"  // cmd:command runs a shell command and reads its output, without the trailing newline.
+)
+
+// resolveSecret resolves a secret reference. Values without a reference prefix are returned unchanged.
+//
+// Parameters:
+//   - value: A plaintext secret or a reference such as env:NAME, file:/path or cmd:command.
+//
+// Returns:
+//   - string: The secret.
+//   - error: An error if the variable is unset, the file cannot be read, or the command fails.
+func resolveSecret(value string) (string, error) {
+	switch {
+	case strings.HasPrefix(value, secretEnvPrefix):
+		name := strings.TrimPrefix(value, secretEnvPrefix)
+		secret, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s is not set", name)
+		}
+		return secret, nil
+	case strings.HasPrefix(value, secretFilePrefix):
+		data, err := os.ReadFile(expandHome(strings.TrimPrefix(value, secretFilePrefix)))
+		if err != nil {
+			return "", fmt.Errorf("read secret file: %w", err)
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	case strings.HasPrefix(value, secretCmdPrefix):
+		command := strings.TrimPrefix(value, secretCmdPrefix)
+		var stderr bytes.Buffer
+		cmd := exec.Command("sh", "-c", command)
+		cmd.Stderr = &stderr
+		out, err := cmd.Output()
+		if err != nil {
+			return "", fmt.Errorf("run %q: %w: %s", command, err, strings.TrimSpace(stderr.String()))
+		}
+		return strings.TrimRight(string(out), "\r\n"), nil
+	}
+	return value, nil
+}
+
+// secretRefs are the prefixes of secret references, each with what the rest of the reference names.
+var secretRefs = []struct{ prefix, target string }{
+	{secretEnvPrefix, "environment variable"},
+	{secretFilePrefix, "file"},
+	{secretCmdPrefix, "command"},
+}
+
+// isSecretRef reports whether a value is a secret reference rather than a plaintext secret.
+func isSecretRef(value string) bool {
+	for _, ref := range secretRefs {
+		if strings.HasPrefix(value, ref.prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// secretRefProblem checks the syntax of a secret reference without resolving it, so that no variable
+// is read and no command is run.
+//
+// Parameters:
+//   - value: A plaintext secret or a reference such as env:NAME, file:/path or cmd:command.
+//
+// Returns:
+//   - string: A description of the problem, or an empty string if the value is a plaintext secret or a
+//     reference naming its target.
+func secretRefProblem(value string) string {
+	for _, ref := range secretRefs {
+		if strings.HasPrefix(value, ref.prefix) && strings.TrimSpace(strings.TrimPrefix(value, ref.prefix)) == "" {
+			return fmt.Sprintf("%s reference names no %s", strings.TrimSuffix(ref.prefix, ":"), ref.target)
+		}
+	}
+	return ""
+}
+
+// forEachSecret calls fn for every password, key passphrase and datastore endpoint of the clusters
+// that is set, with the JSON pointer of its value in the config.
+//
+// Parameters:
+//   - root: The root node of the config, or nil if unknown.
+//   - clusters: The clusters.
+//   - fn: The function called with a pointer to each value and its JSON pointer.
+func forEachSecret(root *yaml.Node, clusters []Cluster, fn func(value *string, pointer string)) {
+	visit := func(value *string, pointer string) {
+		if *value != "" {
+			fn(value, pointer)
+		}
+	}
+	visitHost := func(host *Host, pointer string) {
+		visit(&host.Password, pointer+"/password")
+		visit(&host.KeyPassphrase, pointer+"/keyPassphrase")
+	}
+	visitNode := func(node *Worker, pointer string) {
+		visitHost(&node.Host, pointer)
+		for ji := range node.Jump {
+			visitHost(&node.Jump[ji], fmt.Sprintf("%s/jump/%d", pointer, ji))
+		}
+	}
+
+	for ci := range clusters {
+		cluster := &clusters[ci]
+		base := fmt.Sprintf("%s/%d", clustersPointer(root), ci)
+		visitNode(&cluster.Worker, base)
+		giteaPg := base + "/gitea/pg"
+		if cluster.Addons[AddonGitea].Pg != nil {
+			giteaPg = base + "/addons/" + AddonGitea + "/pg"
+		}
+		visit(&cluster.Gitea.Pg.Password, giteaPg+"/password")
+		visit(&cluster.Datastore.Endpoint, base+"/datastore/endpoint")
+		for wi := range cluster.Workers {
+			visitNode(&cluster.Workers[wi], fmt.Sprintf("%s/workers/%d", base, wi))
+		}
+		for si := range cluster.Servers {
+			visitNode(&cluster.Servers[si], fmt.Sprintf("%s/servers/%d", base, si))
+		}
+	}
+}
+
+// checkSecretRefs checks the syntax of every secret reference in the clusters, as LoadClusters does
+// instead of resolving them.
+//
+// Parameters:
+//   - path: The path of the config.
+//   - root: The root node of the config, used to locate errors.
+//   - clusters: The decoded clusters.
+//
+// Returns:
+//   - ConfigErrors: An error for every malformed reference, or nil.
+func checkSecretRefs(path string, root *yaml.Node, clusters []Cluster) ConfigErrors {
+	var errs ConfigErrors
+	forEachSecret(root, clusters, func(value *string, pointer string) {
+		if problem := secretRefProblem(*value); problem != "" {
+			errs = append(errs, locatedError(path, root, pointer, "%s", problem))
+		}
+	})
+	return errs
+}
+
+// ResolveSecrets resolves the secret references of every password, key passphrase and datastore endpoint
+// in the clusters, and registers the resolved values with utils.MaskSecret so that they are masked in the logs.
+// It is called only before connecting to the nodes, so that loading and validating a config never reads
+// a variable or runs a command. Only the in-memory clusters are updated; the config keeps its references
+// and SaveClusters never writes secrets to the state file.
+//
+// Parameters:
+//   - path: The path of the config the clusters were loaded from, used to locate errors.
+//   - clusters: The slice of Cluster objects to update in place.
+//
+// Returns:
+//   - error: A ConfigErrors with an error for every reference that cannot be resolved and every resolved
+//     datastore endpoint that is invalid, or nil.
+func ResolveSecrets(path string, clusters []Cluster) error {
+	root := configRoot(path)
+	// ValidateClusters leaves a datastore endpoint given as a reference to be checked once it is resolved.
+	endpointRefs := make([]bool, len(clusters))
+	for ci := range clusters {
+		endpointRefs[ci] = isSecretRef(clusters[ci].Datastore.Endpoint)
+	}
+
+	var errs ConfigErrors
+	forEachSecret(root, clusters, func(value *string, pointer string) {
+		secret, err := resolveSecret(*value)
+		if err != nil {
+			errs = append(errs, locatedError(path, root, pointer, "%v", err))
+			return
+		}
+		*value = secret
+		utils.MaskSecret(secret)
+	})
+	for ci := range clusters {
+		endpoint := clusters[ci].Datastore.Endpoint
+		maskEndpointPassword(endpoint)
+		if !endpointRefs[ci] || isSecretRef(endpoint) {
+			// Checked by ValidateClusters, or left unresolved.
+			continue
+		}
+		if problem := endpointProblem(endpoint); problem != "" {
+			errs = append(errs, locatedError(path, root, fmt.Sprintf("%s/%d/datastore/endpoint", clustersPointer(root), ci), "%s", problem))
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
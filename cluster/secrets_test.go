@@ -0,0 +1,84 @@
+package cluster
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSecretReferencesResolvedOnlyByResolveSecrets(t *testing.T) {
+	dir := t.TempDir()
+	marker := filepath.Join(dir, "ran")
+	path := filepath.Join(dir, "clusters.yaml")
+	config := `- address: 10.0.0.1
+  user: root
+  nodeName: master
+  password: "cmd:touch ` + marker + ` && echo from-cmd"
+  keyPassphrase: env:K3SD_TEST_UNSET
+  datastore:
+    endpoint: env:K3SD_TEST_DATASTORE
+`
+	if err := os.WriteFile(path, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("K3SD_TEST_DATASTORE", "redis://db:6379")
+
+	clusters, errs, err := CheckClusters(path)
+	if err != nil || len(errs) > 0 {
+		t.Fatalf("CheckClusters = %v, %v", errs, err)
+	}
+	if _, err := os.Stat(marker); !os.IsNotExist(err) {
+		t.Fatalf("loading and validating the config ran the cmd: reference")
+	}
+	if got := clusters[0].Password; got != "cmd:touch "+marker+" && echo from-cmd" {
+		t.Errorf("password = %q, want the reference kept", got)
+	}
+
+	err = ResolveSecrets(path, clusters)
+	var configErrs ConfigErrors
+	if !errors.As(err, &configErrs) {
+		t.Fatalf("ResolveSecrets = %v, want ConfigErrors", err)
+	}
+	var got []string
+	for _, e := range configErrs {
+		got = append(got, e.Error())
+	}
+	want := []string{
+		path + ":5:18: /0/keyPassphrase: environment variable K3SD_TEST_UNSET is not set",
+		path + ":7:15: /0/datastore/endpoint: endpoint must start with postgres://, mysql://, or http:// or https:// for etcd",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("problems =\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+	if got := clusters[0].Password; got != "from-cmd" {
+		t.Errorf("password = %q, want the output of the command", got)
+	}
+	if _, err := os.Stat(marker); err != nil {
+		t.Errorf("ResolveSecrets did not run the cmd: reference: %v", err)
+	}
+}
+
+func TestCheckSecretReferenceSyntax(t *testing.T) {
+	tests := []struct {
+		value   string
+		problem string
+	}{
+		{"plain", ""},
+		{"env:K3SD_PASS", ""},
+		{"file:/run/secrets/pg", ""},
+		{"cmd:pass show pg", ""},
+		{"env:", "env reference names no environment variable"},
+		{"file: ", "file reference names no file"},
+		{"cmd:", "cmd reference names no command"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			if got := secretRefProblem(tt.value); got != tt.problem {
+				t.Errorf("secretRefProblem(%q) = %q, want %q", tt.value, got, tt.problem)
+			}
+		})
+	}
+}
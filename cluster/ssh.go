@@ -7,106 +7,190 @@ import (
 	"github.com/argon-chat/k3sd/utils"
 	"golang.org/x/crypto/ssh"
 	"io"
+	"os"
+	"path"
+	"regexp"
+	"strings"
 )
 
-// ExecuteCommands runs a list of commands on a remote server via SSH.
+// ExecuteCommands runs a list of commands on a node, stopping at the first failure.
 //
 // Parameters:
-//   - client: An established SSH client connection.
+//   - executor: The Executor for the node.
 //   - commands: A slice of strings, where each string is a command to be executed.
 //
 // Returns:
 //   - error: An error if any command fails to execute, or nil if all commands succeed.
-func ExecuteCommands(client *ssh.Client, commands []string, logger *utils.Logger) error {
+func ExecuteCommands(executor Executor, commands []string) error {
 	for _, cmd := range commands {
-		if err := runCommand(client, cmd, logger); err != nil {
+		if err := executor.Run(cmd); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
-// runCommand creates an SSH session, streams the command's output, and executes the command.
+// ExecuteRemoteScript runs a script through bash on a node and returns its output.
+//
+// Parameters:
+//   - executor: The Executor for the node.
+//   - script: A string containing the script to be executed remotely.
+//
+// Returns:
+//   - string: The standard output of the script execution.
+//   - error: An error if the script fails to execute, or nil if it succeeds.
+func ExecuteRemoteScript(executor Executor, script string) (string, error) {
+	return executor.Output(fmt.Sprintf("bash -c '%s'", script))
+}
+
+// Run creates an SSH session, streams the command's output to the logger, and executes the command.
 //
 // Parameters:
-//   - client: An established SSH client connection.
 //   - cmd: A string representing the command to be executed.
 //
 // Returns:
 //   - error: An error if the command fails to execute, or nil if it succeeds.
-func runCommand(client *ssh.Client, cmd string, logger *utils.Logger) error {
-	session, err := client.NewSession()
+func (c *Connection) Run(cmd string) error {
+	session, err := c.newSession()
 	if err != nil {
-		return fmt.Errorf("failed to create session: %v", err)
+		return err
 	}
-	defer func(session *ssh.Session) {
-		err := session.Close()
-		if err != nil {
-			logger.LogErr("Error closing SSH session: %v\n", err)
-		} else {
-			logger.Log("SSH session closed successfully.\n")
-		}
-	}(session)
+	defer c.closeSession(session)
 
 	stdout, _ := session.StdoutPipe()
 	stderr, _ := session.StderrPipe()
 
-	go streamOutput(stdout, false, logger)
-	go streamOutput(stderr, true, logger)
+	go streamOutput(stdout, false, c.logger)
+	go streamOutput(stderr, true, c.logger)
 
-	logger.LogCmd(cmd)
+	c.logger.LogCmd("%s", cmd)
 	return session.Run(cmd)
 }
 
-// streamOutput reads from an io.Reader and logs each line of output.
+// Output creates an SSH session, executes the command and returns its standard output.
 //
 // Parameters:
-//   - r: The io.Reader to read from (e.g., stdout or stderr).
-//   - isErr: A boolean indicating whether the output is from stderr (true) or stdout (false).
-func streamOutput(r io.Reader, isErr bool, logger *utils.Logger) {
-	scanner := bufio.NewScanner(r)
-	for scanner.Scan() {
-		line := scanner.Text()
-		if isErr {
-			logger.LogErr("%s", line)
-		} else {
-			logger.Log("%s", line)
-		}
+//   - cmd: A string representing the command to be executed.
+//
+// Returns:
+//   - string: The standard output of the command.
+//   - error: An error if the command fails to execute, or nil if it succeeds.
+func (c *Connection) Output(cmd string) (string, error) {
+	session, err := c.newSession()
+	if err != nil {
+		return "", err
+	}
+	defer c.closeSession(session)
+
+	var stdout, stderr bytes.Buffer
+	session.Stdout = &stdout
+	session.Stderr = &stderr
+
+	c.logger.LogCmd("%s", cmd)
+	if err := session.Run(cmd); err != nil {
+		return "", fmt.Errorf("error executing script: %v, stderr: %s", err, stderr.String())
 	}
+
+	return stdout.String(), nil
 }
 
-// ExecuteRemoteScript runs a script on a remote server via SSH and returns its output.
+// Upload writes content to a file on the node, creating its parent directory.
 //
 // Parameters:
-//   - client: An established SSH client connection.
-//   - script: A string containing the script to be executed remotely.
+//   - remotePath: The absolute path of the file on the node.
+//   - content: The content to write.
+//   - mode: The permission bits of the file.
 //
 // Returns:
-//   - string: The standard output of the script execution.
-//   - error: An error if the script fails to execute, or nil if it succeeds.
-func ExecuteRemoteScript(client *ssh.Client, script string, logger *utils.Logger) (string, error) {
-	session, err := client.NewSession()
+//   - error: An error if the file cannot be written.
+func (c *Connection) Upload(remotePath string, content []byte, mode os.FileMode) error {
+	return c.UploadStream(remotePath, bytes.NewReader(content), mode)
+}
+
+// UploadStream copies what a reader yields to a file on the node, creating its parent directory.
+//
+// Parameters:
+//   - remotePath: The absolute path of the file on the node.
+//   - content: The reader of the content, e.g. a local file.
+//   - mode: The permission bits of the file.
+//
+// Returns:
+//   - error: An error if the content cannot be read or the file cannot be written.
+func (c *Connection) UploadStream(remotePath string, content io.Reader, mode os.FileMode) error {
+	session, err := c.newSession()
 	if err != nil {
-		return "", fmt.Errorf("failed to create session: %v", err)
+		return err
 	}
-	defer func(session *ssh.Session) {
-		err := session.Close()
-		if err != nil {
-			logger.LogErr("Error closing SSH session: %v\n", err)
-		} else {
-			logger.Log("SSH session closed successfully.\n")
-		}
-	}(session)
+	defer c.closeSession(session)
 
-	var stdout, stderr bytes.Buffer
-	session.Stdout = &stdout
+	var stderr bytes.Buffer
+	session.Stdin = content
 	session.Stderr = &stderr
 
-	command := fmt.Sprintf("bash -c '%s'", script)
-	logger.LogCmd(command)
-	if err := session.Run(command); err != nil {
-		return "", fmt.Errorf("error executing script: %v, stderr: %s", err, stderr.String())
+	// The umask keeps the file, and any directory created for it, private until chmod widens the file's mode.
+	dir, file := shellQuote(path.Dir(remotePath)), shellQuote(remotePath)
+	cmd := fmt.Sprintf("umask 077 && mkdir -p %s && cat > %s && chmod %o %s", dir, file, mode.Perm(), file)
+	c.logger.LogCmd("upload %s", remotePath)
+	if err := session.Run(cmd); err != nil {
+		return fmt.Errorf("upload %s: %v, stderr: %s", remotePath, err, stderr.String())
 	}
+	return nil
+}
 
-	return stdout.String(), nil
+// shellSafe matches strings that need no quoting in a POSIX shell.
+var shellSafe = regexp.MustCompile(`^[A-Za-z0-9_@%+=:,./-]+$`)
+
+// shellQuote quotes a string as a single POSIX shell word.
+//
+// Parameters:
+//   - s: The string to quote.
+//
+// Returns:
+//   - string: The string itself if it needs no quoting, or the string in single quotes
+//     with embedded single quotes escaped.
+func shellQuote(s string) string {
+	if shellSafe.MatchString(s) {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// newSession opens an SSH session on a live client, reconnecting first if the client has broken.
+func (c *Connection) newSession() (*ssh.Session, error) {
+	client, err := c.Client()
+	if err != nil {
+		return nil, err
+	}
+	session, err := client.NewSession()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create session: %v", err)
+	}
+	return session, nil
+}
+
+// closeSession closes an SSH session and logs the outcome.
+func (c *Connection) closeSession(session *ssh.Session) {
+	err := session.Close()
+	if err != nil {
+		c.logger.LogErr("Error closing SSH session: %v\n", err)
+	} else {
+		c.logger.Log("SSH session closed successfully.\n")
+	}
+}
+
+// streamOutput reads from an io.Reader and logs each line of output.
+//
+// Parameters:
+//   - r: The io.Reader to read from (e.g., stdout or stderr).
+//   - isErr: A boolean indicating whether the output is from stderr (true) or stdout (false).
+func streamOutput(r io.Reader, isErr bool, logger *utils.Logger) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if isErr {
+			logger.LogErr("%s", line)
+		} else {
+			logger.Log("%s", line)
+		}
+	}
 }
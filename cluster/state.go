@@ -0,0 +1,196 @@
+package cluster
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// StateFileSuffix is appended to the name of a cluster config to name the k3sd-owned state file kept next to it.
+const StateFileSuffix = ".k3sd-state.json"
+
+// State is the observed state of every cluster, owned by k3sd and kept apart from the user's config.
+//
+// Fields:
+//   - Clusters: The state of each cluster, keyed by the master's node name.
+type State struct {
+	Clusters map[string]ClusterState `json:"clusters"` // State of each cluster, keyed by master node name.
+}
+
+// ClusterState is the observed state of a cluster.
+//
+// Fields:
+//   - NodeState: The state of the master node.
+//   - Kubeconfig: The path of the kubeconfig saved for the cluster.
+//   - Workers: The state of each worker, keyed by node name.
+//   - Servers: The state of each additional server, keyed by node name.
+type ClusterState struct {
+	NodeState                       // Embeds the master's NodeState.
+	Kubeconfig string               `json:"kubeconfig,omitempty"` // Path of the saved kubeconfig.
+	Workers    map[string]NodeState `json:"workers,omitempty"`    // State of each worker, keyed by node name.
+	Servers    map[string]NodeState `json:"servers,omitempty"`    // State of each additional server, keyed by node name.
+}
+
+// NodeState is the observed state of a node.
+//
+// Fields:
+//   - Done: A boolean indicating whether the node setup is complete.
+//   - Steps: The outcome of each named provisioning step, keyed by step name.
+//   - HostKey: The pinned SHA256 fingerprint of the node's host key.
+//   - JumpHostKeys: The pinned fingerprints of the node's jump hosts, keyed by address.
+//   - K3sVersion: The k3s version installed on the node.
+type NodeState struct {
+	Done         bool                 `json:"done,omitempty"`         // Indicates if the node setup is complete.
+	Steps        map[string]StepState `json:"steps,omitempty"`        // Outcome of each provisioning step.
+	HostKey      string               `json:"hostKey,omitempty"`      // Pinned host key fingerprint.
+	JumpHostKeys map[string]string    `json:"jumpHostKeys,omitempty"` // Pinned jump host fingerprints, keyed by address.
+	K3sVersion   string               `json:"k3sVersion,omitempty"`   // k3s version installed on the node.
+}
+
+// statePath returns the path of the state file belonging to a cluster config. Each config has its own,
+// so that configs in the same directory neither overwrite each other's state nor share it through
+// a reused node name.
+//
+// Parameters:
+//   - configPath: The path of the cluster config.
+//
+// Returns:
+//   - string: The path of the state file in the same directory, e.g. clusters.yaml.k3sd-state.json.
+func statePath(configPath string) string {
+	return configPath + StateFileSuffix
+}
+
+// loadState reads and, if encrypted, decrypts the state file belonging to a cluster config.
+// A missing file yields an empty State.
+//
+// Parameters:
+//   - configPath: The path of the cluster config.
+//
+// Returns:
+//   - State: The decoded state.
+//   - error: An error if the file exists but cannot be read or decoded.
+func loadState(configPath string) (State, error) {
+	state := State{Clusters: map[string]ClusterState{}}
+	data, err := os.ReadFile(statePath(configPath))
+	if errors.Is(err, os.ErrNotExist) {
+		return state, nil
+	}
+	if err != nil {
+		return state, fmt.Errorf("read state: %w", err)
+	}
+	if isAgeEncrypted(data) {
+		if data, err = decryptAge(data); err != nil {
+			return state, fmt.Errorf("decrypt state: %w", err)
+		}
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return state, fmt.Errorf("decode state: %w", err)
+	}
+	if state.Clusters == nil {
+		state.Clusters = map[string]ClusterState{}
+	}
+	return state, nil
+}
+
+// applyState overlays the observed state onto clusters loaded from the config.
+// Nodes without recorded state keep whatever the config says, so older configs carrying
+// `done` flags and host keys keep working until their first save.
+//
+// Parameters:
+//   - clusters: The slice of Cluster objects to update in place.
+//   - state: The observed state.
+func applyState(clusters []Cluster, state State) {
+	for ci := range clusters {
+		cluster := &clusters[ci]
+		cs, ok := state.Clusters[cluster.NodeName]
+		if !ok {
+			continue
+		}
+		cs.NodeState.applyTo(&cluster.Worker)
+		if cs.Kubeconfig != "" {
+			cluster.Kubeconfig = cs.Kubeconfig
+		}
+		for wi := range cluster.Workers {
+			if ws, ok := cs.Workers[cluster.Workers[wi].NodeName]; ok {
+				ws.applyTo(&cluster.Workers[wi])
+			}
+		}
+		for si := range cluster.Servers {
+			if ss, ok := cs.Servers[cluster.Servers[si].NodeName]; ok {
+				ss.applyTo(&cluster.Servers[si])
+			}
+		}
+	}
+}
+
+// collectState extracts the observed state from clusters.
+//
+// Parameters:
+//   - clusters: The slice of Cluster objects to read.
+//
+// Returns:
+//   - State: The observed state of every cluster.
+func collectState(clusters []Cluster) State {
+	state := State{Clusters: map[string]ClusterState{}}
+	for _, cluster := range clusters {
+		cs := ClusterState{
+			NodeState:  nodeStateOf(cluster.Worker),
+			Kubeconfig: cluster.Kubeconfig,
+			Workers:    map[string]NodeState{},
+			Servers:    map[string]NodeState{},
+		}
+		for _, worker := range cluster.Workers {
+			cs.Workers[worker.NodeName] = nodeStateOf(worker)
+		}
+		for _, server := range cluster.Servers {
+			cs.Servers[server.NodeName] = nodeStateOf(server)
+		}
+		state.Clusters[cluster.NodeName] = cs
+	}
+	return state
+}
+
+// nodeStateOf extracts the observed state of a node.
+//
+// Parameters:
+//   - node: The Worker to read.
+//
+// Returns:
+//   - NodeState: The node's observed state.
+func nodeStateOf(node Worker) NodeState {
+	ns := NodeState{
+		Done:       node.Done,
+		Steps:      node.Steps,
+		HostKey:    node.HostKey,
+		K3sVersion: node.InstalledVersion,
+	}
+	for _, hop := range node.Jump {
+		if hop.HostKey == "" {
+			continue
+		}
+		if ns.JumpHostKeys == nil {
+			ns.JumpHostKeys = map[string]string{}
+		}
+		ns.JumpHostKeys[hop.Address] = hop.HostKey
+	}
+	return ns
+}
+
+// applyTo overlays the node state onto a node loaded from the config.
+//
+// Parameters:
+//   - node: A pointer to the Worker to update.
+func (ns NodeState) applyTo(node *Worker) {
+	node.Done = ns.Done
+	node.Steps = ns.Steps
+	node.InstalledVersion = ns.K3sVersion
+	if ns.HostKey != "" {
+		node.HostKey = ns.HostKey
+	}
+	for i := range node.Jump {
+		if key, ok := ns.JumpHostKeys[node.Jump[i].Address]; ok {
+			node.Jump[i].HostKey = key
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package cluster
+
+import (
+	"fmt"
+	"github.com/argon-chat/k3sd/utils"
+	"slices"
+	"time"
+)
+
+// Step statuses recorded in a node's step history.
+const (
+	StepDone   = "done"
+	StepFailed = "failed"
+)
+
+// step is a named unit of provisioning work whose outcome is checkpointed on the node.
+type step struct {
+	name string       // Name recorded in the node's step history and accepted by --force-step.
+	run  func() error // Work performed by the step.
+}
+
+// commandStep creates a step that runs a list of commands on a node.
+//
+// Parameters:
+//   - name: The name of the step.
+//   - executor: The Executor for the node the commands run on.
+//   - commands: The commands to run, in order.
+//
+// Returns:
+//   - step: The step.
+func commandStep(name string, executor Executor, commands ...string) step {
+	return step{name: name, run: func() error {
+		return ExecuteCommands(executor, commands)
+	}}
+}
+
+// runSteps runs a node's steps in order, skipping those that should not run and
+// recording and persisting the status and time of each one that does.
+//
+// Parameters:
+//   - node: A pointer to the Worker whose step history is read and updated.
+//   - steps: The steps to run, in order.
+//   - logger: A pointer to a utils.Logger instance for logging operations.
+//   - commit: The checkpoint used to record each step's outcome.
+//
+// Returns:
+//   - error: An error naming the first step that fails.
+func runSteps(node *Worker, steps []step, logger *utils.Logger, commit checkpoint) error {
+	for _, s := range steps {
+		if !shouldRunStep(*node, s.name) {
+			logger.Log("Skipping completed step %s", s.name)
+			continue
+		}
+		logger.Log("Running step %s", s.name)
+		err := s.run()
+		commit(func() { node.recordStep(s.name, err) })
+		if err != nil {
+			return fmt.Errorf("step %s: %w", s.name, err)
+		}
+	}
+	return nil
+}
+
+// shouldRunStep reports whether a step should run on a node. Forced steps always run;
+// otherwise a step runs only on an unfinished node where it has not completed yet.
+//
+// Parameters:
+//   - node: The Worker whose step history is checked.
+//   - name: The name of the step.
+//
+// Returns:
+//   - bool: True if the step should run.
+func shouldRunStep(node Worker, name string) bool {
+	if slices.Contains(utils.ForceSteps, name) {
+		return true
+	}
+	return !node.Done && node.Steps[name].Status != StepDone
+}
+
+// hasForcedSteps reports whether any step was forced with --force-step,
+// in which case finished nodes are revisited.
+func hasForcedSteps() bool {
+	return len(utils.ForceSteps) > 0
+}
+
+// recordStep stores the outcome of a step in the node's step history.
+//
+// Parameters:
+//   - name: The name of the step.
+//   - err: The error returned by the step, or nil if it succeeded.
+func (w *Worker) recordStep(name string, err error) {
+	if w.Steps == nil {
+		w.Steps = map[string]StepState{}
+	}
+	state := StepState{Status: StepDone, Time: time.Now().UTC()}
+	if err != nil {
+		state.Status = StepFailed
+		state.Error = err.Error()
+	}
+	w.Steps[name] = state
+}
+
+// installed reports whether k3s may be installed on a node, either because the node
+// finished provisioning or because its k3s-install step completed.
+func (w Worker) installed() bool {
+	return w.Done || w.Steps["k3s-install"].Status == StepDone
+}
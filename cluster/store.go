@@ -2,45 +2,193 @@ package cluster
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"github.com/argon-chat/k3sd/utils"
 	"os"
+	"path/filepath"
+	"sync"
 )
 
-// LoadClusters reads a JSON file from the specified path and decodes it into a slice of Cluster objects.
+// SaveFunc persists the state of every cluster.
+type SaveFunc func(clusters []Cluster) error
+
+// stateMu guards cluster state that provisioning goroutines update concurrently, and its persistence.
+var stateMu sync.Mutex
+
+// checkpoint applies an update to the cluster state and persists the result.
+type checkpoint func(update func())
+
+// newCheckpoint creates a checkpoint that saves every cluster after each update.
 //
 // Parameters:
-//   - path: A string representing the file path to the JSON file.
+//   - clusters: The slice of Cluster objects being updated.
+//   - save: The SaveFunc used to persist them; nil disables persistence.
+//   - logger: A pointer to a utils.Logger instance for logging save failures.
 //
 // Returns:
-//   - []Cluster: A slice of Cluster objects decoded from the JSON file.
-//   - Error: An error if the file cannot be opened or the JSON cannot be decoded.
+//   - checkpoint: The checkpoint.
+func newCheckpoint(clusters []Cluster, save SaveFunc, logger *utils.Logger) checkpoint {
+	return func(update func()) {
+		stateMu.Lock()
+		defer stateMu.Unlock()
+		update()
+		if save == nil {
+			return
+		}
+		if err := save(clusters); err != nil {
+			logger.LogErr("Failed to save cluster state: %v", err)
+		}
+	}
+}
+
+// LoadClusters reads a YAML, JSONC or JSON config file from the specified path, validates it against
+// Schema, decodes it into a slice of Cluster objects, and overlays the observed state recorded in the
+// state file next to it.
+//
+// Parameters:
+//   - path: A string representing the file path to the config file.
+//
+// Returns:
+//   - []Cluster: A slice of Cluster objects decoded from the config file, also returned along with
+//     a ConfigErrors if the config decodes but has problems, so that they can be checked further.
+//   - Error: An error if the config or state cannot be read, or a ConfigErrors listing every problem
+//     found in the config, with its line and column.
 func LoadClusters(path string) ([]Cluster, error) {
-	file, err := os.Open(path)
+	data, err := os.ReadFile(path)
 	if err != nil {
 		return nil, fmt.Errorf("open cluster config: %w", err)
 	}
-	defer file.Close()
 
-	var clusters []Cluster
-	err = json.NewDecoder(file).Decode(&clusters)
-	if err != nil {
-		return nil, fmt.Errorf("decode cluster config: %w", err)
+	clusters, err := decodeConfig(path, data)
+	if clusters == nil {
+		return nil, err
+	}
+
+	state, stateErr := loadState(path)
+	if stateErr != nil {
+		return nil, stateErr
 	}
-	return clusters, nil
+	applyState(clusters, state)
+	return clusters, err
 }
 
-// SaveClusters encodes a slice of Cluster objects into JSON format and writes it to the specified file path.
+// CheckClusters loads a config with LoadClusters and checks it with ValidateClusters, without connecting
+// to any host, so that the problems found while loading it and those of the loaded clusters are
+// reported in one run.
 //
 // Parameters:
-//   - path: A string representing the file path where the JSON data will be written.
-//   - clusters: A slice of Cluster objects to be encoded into JSON.
+//   - path: A string representing the file path to the config file.
 //
 // Returns:
-//   - error: An error if the JSON cannot be marshaled or the file cannot be written.
+//   - []Cluster: The decoded clusters, or nil if the config cannot be decoded.
+//   - ConfigErrors: Every problem found, in the order of the checks, or nil if the config is valid.
+//   - error: An error if the config or state cannot be read.
+func CheckClusters(path string) ([]Cluster, ConfigErrors, error) {
+	clusters, err := LoadClusters(path)
+	var errs ConfigErrors
+	if err != nil && !errors.As(err, &errs) {
+		return nil, nil, err
+	}
+	if clusters != nil {
+		errs = append(errs, ValidateClusters(path, clusters)...)
+	}
+	return clusters, errs, nil
+}
+
+// SaveClusters writes the observed state of the clusters to the config's own state file next to it.
+// The config file itself is never rewritten. The state file is replaced atomically, so that
+// an interrupted write never leaves a truncated file behind. Passwords and other secrets
+// are never written; the state file is readable by its owner only. When the config is encrypted,
+// the state file is encrypted with age to the same recipients, so that it can be committed next to it.
+//
+// Parameters:
+//   - path: A string representing the file path of the cluster config.
+//   - clusters: A slice of Cluster objects whose state is saved.
+//
+// Returns:
+//   - error: An error if the state cannot be marshaled or the file cannot be written.
 func SaveClusters(path string, clusters []Cluster) error {
-	data, err := json.MarshalIndent(clusters, "", "  ")
+	data, err := json.MarshalIndent(collectState(clusters), "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshal cluster state: %w", err)
+	}
+	recipients, err := configRecipients(path)
 	if err != nil {
-		return fmt.Errorf("marshal cluster config: %w", err)
+		return err
+	}
+	if recipients != nil {
+		if data, err = encryptAge(data, recipients); err != nil {
+			return err
+		}
+	}
+	return writeFileAtomic(statePath(path), data, 0600)
+}
+
+// LockClusters creates a lock file next to the config so that concurrent k3sd runs cannot
+// overwrite each other's state.
+//
+// Parameters:
+//   - path: A string representing the file path of the cluster config.
+//
+// Returns:
+//   - func() error: A function that releases the lock; calls after the first do nothing.
+//   - error: An error if another run holds the lock or the lock file cannot be created.
+func LockClusters(path string) (func() error, error) {
+	lockPath := path + ".lock"
+	file, err := os.OpenFile(lockPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if errors.Is(err, os.ErrExist) {
+		owner, _ := os.ReadFile(lockPath)
+		return nil, fmt.Errorf("%s is locked by another k3sd run (pid %s); remove the lock file if that run is gone", path, owner)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("create lock file: %w", err)
+	}
+	_, err = fmt.Fprintf(file, "%d", os.Getpid())
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(lockPath)
+		return nil, fmt.Errorf("write lock file: %w", err)
+	}
+	var once sync.Once
+	return func() error {
+		var err error
+		once.Do(func() { err = os.Remove(lockPath) })
+		return err
+	}, nil
+}
+
+// writeFileAtomic writes data to a temporary file in the target's directory and renames it over the target.
+//
+// Parameters:
+//   - path: The path of the file to replace.
+//   - data: The content to write.
+//   - perm: The permission bits of the file.
+//
+// Returns:
+//   - error: An error if the temporary file cannot be written or renamed.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return fmt.Errorf("create temp file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("write temp file: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("sync temp file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("close temp file: %w", err)
+	}
+	if err := os.Chmod(tmp.Name(), perm); err != nil {
+		return fmt.Errorf("chmod temp file: %w", err)
 	}
-	return os.WriteFile(path, data, 0644)
+	return os.Rename(tmp.Name(), path)
 }
@@ -3,34 +3,27 @@ package cluster
 import (
 	"fmt"
 	"github.com/argon-chat/k3sd/utils"
-	"golang.org/x/crypto/ssh"
 )
 
-// UninstallCluster removes the K3s installation from the specified clusters and their workers.
+// UninstallCluster removes the K3s installation from the specified clusters: their addons first, then
+// their workers, their additional servers and finally their first server.
 //
 // Parameters:
 //   - clusters: A slice of Cluster objects representing the clusters to be uninstalled.
+//   - save: A SaveFunc called after every uninstalled node; may be nil.
 //
 // Returns:
 //   - []Cluster: The updated slice of Cluster objects with their statuses reset.
 //   - Error: An error if any step in the uninstallation process fails.
-func UninstallCluster(clusters []Cluster, logger *utils.Logger) ([]Cluster, error) {
+func UninstallCluster(clusters []Cluster, logger *utils.Logger, save SaveFunc) ([]Cluster, error) {
+	commit := newCheckpoint(clusters, save, logger)
 	for ci, cluster := range clusters {
-		// Configure SSH client for connecting to the cluster.
-		config := &ssh.ClientConfig{
-			User: cluster.User,
-			Auth: []ssh.AuthMethod{
-				ssh.Password(cluster.Password),
-			},
-			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
-		}
-
 		// Establish an SSH connection to the cluster.
-		client, err := ssh.Dial("tcp", cluster.Address+":22", config)
+		client, err := Dial(&clusters[ci].Host, clusters[ci].Jump, logger)
 		if err != nil {
 			return nil, fmt.Errorf("Error connecting to cluster %s: %v\n", cluster.Address, err)
 		}
-		defer func(client *ssh.Client) {
+		defer func(client Executor) {
 			err := client.Close()
 			if err != nil {
 				logger.LogErr("Error closing SSH connection to %s: %v\n", cluster.Address, err)
@@ -39,26 +32,106 @@ func UninstallCluster(clusters []Cluster, logger *utils.Logger) ([]Cluster, erro
 			}
 		}(client)
 
+		if cluster.installed() {
+			uninstallAddons(cluster, client, logger)
+		}
+
 		// Uninstall K3s agent from each worker node in the cluster.
 		for wi, worker := range cluster.Workers {
-			if worker.Done {
-				if err := ExecuteCommands(client, []string{
-					fmt.Sprintf("ssh %s@%s \"k3s-agent-uninstall.sh\"", worker.User, worker.Address),
-				}, logger); err != nil {
-					logger.Log("Error uninstalling worker on %s: %v\n", cluster.Address, err)
+			if worker.installed() {
+				if err := uninstallNode(&clusters[ci].Workers[wi], cluster.WorkerJump(worker), "k3s-agent-uninstall.sh", logger); err != nil {
+					logger.Log("Error uninstalling worker on %s: %v\n", worker.Address, err)
+				}
+				commit(func() {
+					clusters[ci].Workers[wi].Done = false
+					clusters[ci].Workers[wi].Steps = nil
+					clusters[ci].Workers[wi].InstalledVersion = ""
+				})
+			}
+		}
+
+		// Uninstall K3s from each additional server.
+		for si, server := range cluster.Servers {
+			if server.installed() {
+				if err := uninstallNode(&clusters[ci].Servers[si], cluster.WorkerJump(server), "k3s-uninstall.sh", logger); err != nil {
+					logger.Log("Error uninstalling server on %s: %v\n", server.Address, err)
 				}
-				clusters[ci].Workers[wi].Done = false
+				commit(func() {
+					clusters[ci].Servers[si].Done = false
+					clusters[ci].Servers[si].Steps = nil
+					clusters[ci].Servers[si].InstalledVersion = ""
+				})
 			}
 		}
 
-		if cluster.Done {
+		if cluster.installed() {
 			// Uninstall K3s from the master node.
-			if err := ExecuteCommands(client, []string{"k3s-uninstall.sh"}, logger); err != nil {
+			if err := ExecuteCommands(client, []string{"k3s-uninstall.sh"}); err != nil {
 				logger.Log("Error uninstalling master on %s: %v\n", cluster.Address, err)
 			}
-			clusters[ci].Done = false
+			commit(func() {
+				clusters[ci].Done = false
+				clusters[ci].Steps = nil
+				clusters[ci].InstalledVersion = ""
+			})
 		}
 	}
 
 	return clusters, nil
 }
+
+// uninstallNode connects to a worker or an additional server with its own credentials and removes K3s.
+//
+// Parameters:
+//   - node: A pointer to the Worker to uninstall.
+//   - jump: The bastion hosts to hop through, in order, to reach the node.
+//   - script: The uninstall script, k3s-agent-uninstall.sh on a worker and k3s-uninstall.sh on a server.
+//   - logger: A pointer to a utils.Logger instance for logging operations.
+//
+// Returns:
+//   - error: An error if the connection or the uninstall script fails.
+func uninstallNode(node *Worker, jump []Host, script string, logger *utils.Logger) error {
+	client, err := Dial(&node.Host, jump, logger)
+	if err != nil {
+		return err
+	}
+	defer func(client Executor) {
+		if err := client.Close(); err != nil {
+			logger.LogErr("Error closing SSH connection to %s: %v\n", node.Address, err)
+		}
+	}(client)
+
+	return ExecuteCommands(client, []string{script})
+}
+
+// uninstallAddons removes the addons enabled on a cluster, each before the addons it depends on, skipping
+// those whose status shows they are not installed. A failure is logged and does not stop the others
+// or the removal of K3s.
+//
+// Parameters:
+//   - cluster: The cluster whose addons are removed.
+//   - master: The Executor for the cluster's master node.
+//   - logger: A pointer to a utils.Logger instance for logging operations.
+func uninstallAddons(cluster Cluster, master Executor, logger *utils.Logger) {
+	addons, err := clusterAddons(cluster)
+	if err != nil {
+		logger.LogErr("Error resolving the addons of %s: %v\n", cluster.Address, err)
+		return
+	}
+	env := AddonEnv{Cluster: cluster, Master: master, Kubeconfig: cluster.Kubeconfig, Logger: logger}
+	for i := len(addons) - 1; i >= 0; i-- {
+		addon := addons[i]
+		installed, err := addon.Status(env)
+		if err != nil {
+			logger.LogErr("Error checking addon %s on %s: %v\n", addon.Name(), cluster.Address, err)
+			continue
+		}
+		if !installed {
+			logger.Log("Addon %s is not installed on %s, skipping.\n", addon.Name(), cluster.Address)
+			continue
+		}
+		if err := addon.Uninstall(env); err != nil {
+			logger.LogErr("Error uninstalling addon %s on %s: %v\n", addon.Name(), cluster.Address, err)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package cluster
+
+import (
+	"golang.org/x/crypto/ssh"
+	"reflect"
+	"testing"
+)
+
+func TestUninstallClusterAddons(t *testing.T) {
+	dialer := NewFakeDialer()
+	previous := Dial
+	Dial = dialer.Dial
+	t.Cleanup(func() { Dial = previous })
+
+	master := dialer.Executor("10.0.0.1")
+	master.Results["kubectl get clusterissuer letsencrypt-prod"] = FakeResult{Err: &ssh.ExitError{}}
+
+	enabled, disabled := true, false
+	cluster := Cluster{Domain: "example.com", Addons: map[string]AddonConfig{
+		AddonClusterIssuer: {Enabled: &enabled},
+		AddonGiteaIngress:  {Enabled: &enabled},
+		AddonPrometheus:    {Enabled: &disabled},
+		AddonTraefik:       {Enabled: &disabled},
+		AddonLinkerd:       {Enabled: &disabled},
+		AddonLinkerdMC:     {Enabled: &disabled},
+	}}
+	cluster.Address, cluster.NodeName, cluster.Done = "10.0.0.1", "master", true
+	cluster.Gitea.Pg = Pg{Username: "gitea", Password: "pg-secret", DbName: "gitea"}
+
+	clusters, err := UninstallCluster([]Cluster{cluster}, newTestLogger(), nil)
+	if err != nil {
+		t.Fatalf("UninstallCluster: %v", err)
+	}
+	if clusters[0].installed() {
+		t.Errorf("the master is still marked installed")
+	}
+
+	// Dependents go first, and the cluster issuer, whose status fails, is skipped.
+	want := []string{
+		"kubectl get ingress git-tls-ingress",
+		"kubectl delete --ignore-not-found ingress git-tls-ingress",
+		"kubectl get deployment gitea",
+		"kubectl delete --ignore-not-found -f /tmp/yamls/gitea.yaml",
+		"kubectl get clusterissuer letsencrypt-prod",
+		"kubectl get deployment cert-manager --namespace cert-manager",
+		"kubectl delete --ignore-not-found -f https://github.com/cert-manager/cert-manager/releases/download/v1.17.2/cert-manager.yaml",
+		"kubectl delete --ignore-not-found -f https://github.com/cert-manager/cert-manager/releases/download/v1.17.2/cert-manager.crds.yaml",
+		"k3s-uninstall.sh",
+	}
+	if !reflect.DeepEqual(master.Commands, want) {
+		t.Errorf("master commands = %q, want %q", master.Commands, want)
+	}
+	if _, ok := master.Uploads["/tmp/yamls/gitea.yaml"]; !ok {
+		t.Errorf("the gitea manifest was not uploaded before removing it")
+	}
+}
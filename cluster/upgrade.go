@@ -0,0 +1,275 @@
+package cluster
+
+import (
+	"fmt"
+	"github.com/argon-chat/k3sd/utils"
+	"regexp"
+	"strings"
+)
+
+// upgradeTimeout bounds, in seconds, each wait of an upgrade: for the API, the new version, node readiness and draining.
+const upgradeTimeout = 300
+
+// k3sVersionPattern matches a k3s release, e.g. v1.32.3+k3s1.
+var k3sVersionPattern = regexp.MustCompile(`^v[0-9]+\.[0-9]+\.[0-9]+(-rc[0-9]+)?\+k3s[0-9]+$`)
+
+// UpgradeCluster upgrades k3s on every installed node of the clusters to a release, one node at a time:
+// first the servers, then each worker, cordoned and drained while its agent is reinstalled and uncordoned
+// once it is Ready again. Each node's k3s config, and each server's datastore TLS files, are rewritten from
+// the cluster config before its reinstall. A cluster stops at the first node that does not come back healthy,
+// leaving a worker cordoned. Each upgraded node's version is recorded in the state file, so a resumed upgrade
+// skips the nodes already on the release.
+//
+// Parameters:
+//   - clusters: A slice of Cluster objects representing the clusters to upgrade.
+//   - version: The k3s release to upgrade to, e.g. v1.32.3+k3s1.
+//   - logger: A pointer to a utils.Logger instance for logging operations.
+//   - save: A SaveFunc called after every upgraded node, so progress survives a failure; may be nil.
+//
+// Returns:
+//   - []Cluster: The updated slice of Cluster objects.
+//   - error: An error if the version is malformed, the air-gap bundle holds another release, or a node fails to upgrade.
+func UpgradeCluster(clusters []Cluster, version string, logger *utils.Logger, save SaveFunc) ([]Cluster, error) {
+	if !k3sVersionPattern.MatchString(version) {
+		return nil, fmt.Errorf("invalid k3s version %q, want e.g. v1.32.3+k3s1", version)
+	}
+	if airgapped() {
+		bundled, err := bundledK3sVersion()
+		if err != nil {
+			return nil, err
+		}
+		if bundled != version {
+			return nil, fmt.Errorf("airgap bundle %s holds k3s %s, not %s; build one with k3sd bundle --k3s-version %s", utils.AirgapBundle, bundled, version, version)
+		}
+	}
+	commit := newCheckpoint(clusters, save, logger)
+	err := forEachParallel(len(clusters), utils.Parallel, func(ci int) error {
+		return upgradeCluster(&clusters[ci], version, logger.WithPrefix(clusters[ci].NodeName), commit)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return clusters, nil
+}
+
+// upgradeCluster upgrades a single cluster's first server, its additional servers and then its workers, one at a time.
+//
+// Parameters:
+//   - cluster: A pointer to the Cluster to upgrade; the installed versions are updated in place.
+//   - version: The k3s release to upgrade to.
+//   - logger: A pointer to a utils.Logger instance for logging operations.
+//   - commit: The checkpoint used to update and persist the cluster state.
+//
+// Returns:
+//   - error: An error if a node fails to upgrade or is unhealthy afterwards.
+func upgradeCluster(cluster *Cluster, version string, logger *utils.Logger, commit checkpoint) error {
+	if !cluster.installed() {
+		logger.Log("Skipping cluster %s: k3s is not installed", cluster.NodeName)
+		return nil
+	}
+	if cluster.K3sVersion != version {
+		logger.Log("Set k3sVersion to %s in the config, so that nodes joined later run the same release", version)
+	}
+	// Reinstall with the target release pinned, whatever the config pins.
+	target := *cluster
+	target.K3sVersion, target.K3sChannel = version, ""
+
+	client, err := Dial(&cluster.Host, cluster.Jump, logger)
+	if err != nil {
+		return err
+	}
+	defer func(client Executor) {
+		if err := client.Close(); err != nil {
+			logger.LogErr("Error closing SSH connection to %s: %v\n", cluster.Address, err)
+		}
+	}(client)
+
+	if cluster.InstalledVersion == version {
+		logger.Log("Server %s already runs %s", cluster.NodeName, version)
+	} else {
+		logger.Log("Upgrading server %s from %s to %s", cluster.NodeName, displayVersion(cluster.InstalledVersion), version)
+		if airgapped() {
+			if err := airgapStep(client, true).run(); err != nil {
+				return fmt.Errorf("upgrade server %s: %v", cluster.NodeName, err)
+			}
+		}
+		for _, step := range datastoreSteps(client, cluster.Datastore) {
+			if err := step.run(); err != nil {
+				return fmt.Errorf("upgrade server %s: %v", cluster.NodeName, err)
+			}
+		}
+		if err := k3sConfigStep(client, func() ([]byte, error) { return serverK3sConfig(*cluster) }).run(); err != nil {
+			return fmt.Errorf("upgrade server %s: %v", cluster.NodeName, err)
+		}
+		if err := client.Run(k3sInstallCommand(target, serverInstallEnv)); err != nil {
+			return fmt.Errorf("upgrade server %s: %v", cluster.NodeName, err)
+		}
+		if err := waitNodeUpgraded(client, cluster.NodeName, version); err != nil {
+			return fmt.Errorf("server %s is unhealthy after the upgrade: %v", cluster.NodeName, err)
+		}
+		commit(func() { cluster.InstalledVersion = version })
+	}
+
+	for si := range cluster.Servers {
+		server := &cluster.Servers[si]
+		switch {
+		case !server.installed():
+			logger.Log("Skipping server %s: k3s is not installed", server.NodeName)
+			continue
+		case server.InstalledVersion == version:
+			logger.Log("Server %s already runs %s", server.NodeName, version)
+			continue
+		}
+		serverLogger := logger.WithPrefix(server.NodeName)
+		serverLogger.Log("Upgrading server %s from %s to %s", server.NodeName, displayVersion(server.InstalledVersion), version)
+		if err := upgradeServer(client, target, server, version, serverLogger); err != nil {
+			return fmt.Errorf("server %s: %v", server.NodeName, err)
+		}
+		commit(func() { server.InstalledVersion = version })
+	}
+
+	for wi := range cluster.Workers {
+		worker := &cluster.Workers[wi]
+		switch {
+		case !worker.installed():
+			logger.Log("Skipping worker %s: k3s is not installed", worker.NodeName)
+			continue
+		case worker.InstalledVersion == version:
+			logger.Log("Worker %s already runs %s", worker.NodeName, version)
+			continue
+		}
+		workerLogger := logger.WithPrefix(worker.NodeName)
+		workerLogger.Log("Upgrading worker %s from %s to %s", worker.NodeName, displayVersion(worker.InstalledVersion), version)
+		if err := upgradeWorker(client, target, worker, version, workerLogger); err != nil {
+			return fmt.Errorf("worker %s: %v", worker.NodeName, err)
+		}
+		commit(func() { worker.InstalledVersion = version })
+	}
+	logger.Log("Cluster %s runs %s", cluster.NodeName, version)
+	return nil
+}
+
+// upgradeServer reinstalls k3s on an additional server at the target release, rejoining it with the
+// server token, and waits for it to be Ready on that release. Like the first server, it is not drained.
+//
+// Parameters:
+//   - master: The Executor to the cluster's master node, where kubectl has cluster access.
+//   - cluster: The cluster, with the target release pinned.
+//   - server: A pointer to the additional server to upgrade.
+//   - version: The k3s release to upgrade to.
+//   - logger: A pointer to a utils.Logger instance for logging operations.
+//
+// Returns:
+//   - error: An error if the install or the health checks fail.
+func upgradeServer(master Executor, cluster Cluster, server *Worker, version string, logger *utils.Logger) error {
+	client, err := Dial(&server.Host, cluster.WorkerJump(*server), logger)
+	if err != nil {
+		return err
+	}
+	defer func(client Executor) {
+		if err := client.Close(); err != nil {
+			logger.LogErr("Error closing SSH connection to %s: %v\n", server.Address, err)
+		}
+	}(client)
+
+	if airgapped() {
+		if err := airgapStep(client, false).run(); err != nil {
+			return err
+		}
+	}
+	for _, step := range datastoreSteps(client, cluster.Datastore) {
+		if err := step.run(); err != nil {
+			return err
+		}
+	}
+	if err := k3sConfigStep(client, func() ([]byte, error) { return joinedServerK3sConfig(cluster, *server) }).run(); err != nil {
+		return err
+	}
+	if err := installJoinedServer(master, client, cluster); err != nil {
+		return err
+	}
+	if err := waitNodeUpgraded(master, server.NodeName, version); err != nil {
+		return fmt.Errorf("unhealthy after the upgrade: %v", err)
+	}
+	return nil
+}
+
+// upgradeWorker cordons and drains a worker, reinstalls its agent at the target release, waits for it
+// to be Ready on that release and uncordons it. A worker that does not come back healthy is left cordoned.
+//
+// Parameters:
+//   - master: The Executor to the cluster's master node, where kubectl has cluster access.
+//   - cluster: The cluster, with the target release pinned.
+//   - worker: A pointer to the Worker to upgrade.
+//   - version: The k3s release to upgrade to.
+//   - logger: A pointer to a utils.Logger instance for logging operations.
+//
+// Returns:
+//   - error: An error if draining, the install or the health checks fail.
+func upgradeWorker(master Executor, cluster Cluster, worker *Worker, version string, logger *utils.Logger) error {
+	client, err := Dial(&worker.Host, cluster.WorkerJump(*worker), logger)
+	if err != nil {
+		return err
+	}
+	defer func(client Executor) {
+		if err := client.Close(); err != nil {
+			logger.LogErr("Error closing SSH connection to %s: %v\n", worker.Address, err)
+		}
+	}(client)
+
+	if err := ExecuteCommands(master, []string{
+		fmt.Sprintf("kubectl cordon %s", worker.NodeName),
+		fmt.Sprintf("kubectl drain %s --ignore-daemonsets --delete-emptydir-data --timeout=%ds", worker.NodeName, upgradeTimeout),
+	}); err != nil {
+		return fmt.Errorf("drain: %v", err)
+	}
+	if airgapped() {
+		if err := airgapStep(client, false).run(); err != nil {
+			return err
+		}
+	}
+	if err := k3sConfigStep(client, func() ([]byte, error) { return agentK3sConfig(cluster, *worker) }).run(); err != nil {
+		return err
+	}
+	if err := installAgent(master, client, cluster); err != nil {
+		return err
+	}
+	if err := waitNodeUpgraded(master, worker.NodeName, version); err != nil {
+		return fmt.Errorf("unhealthy after the upgrade, left cordoned: %v", err)
+	}
+	return master.Run(fmt.Sprintf("kubectl uncordon %s", worker.NodeName))
+}
+
+// waitNodeUpgraded waits for the API server to answer, the node's kubelet to report the target release
+// and the node to be Ready.
+//
+// Parameters:
+//   - master: The Executor to the cluster's master node, where kubectl has cluster access.
+//   - nodeName: The name of the node.
+//   - version: The k3s release the node should run.
+//
+// Returns:
+//   - error: An error if any wait times out.
+func waitNodeUpgraded(master Executor, nodeName, version string) error {
+	waits := []struct{ what, cmd string }{
+		{"API server", "until kubectl get --raw=/readyz >/dev/null 2>&1; do sleep 5; done"},
+		{"the kubelet to report " + version, fmt.Sprintf(`until [ "$(kubectl get node %s -o jsonpath={.status.nodeInfo.kubeletVersion})" = %s ]; do sleep 5; done`, nodeName, shellQuote(version))},
+	}
+	for _, wait := range waits {
+		if err := master.Run(fmt.Sprintf("timeout %d sh -c %s", upgradeTimeout, shellQuote(wait.cmd))); err != nil {
+			return fmt.Errorf("waiting for %s: %v", wait.what, err)
+		}
+	}
+	if err := master.Run(fmt.Sprintf("kubectl wait --for=condition=Ready node/%s --timeout=%ds", nodeName, upgradeTimeout)); err != nil {
+		return fmt.Errorf("waiting for node Ready: %v", err)
+	}
+	return nil
+}
+
+// displayVersion returns a recorded k3s version for display, or "an unknown version" if none is recorded.
+func displayVersion(version string) string {
+	if strings.TrimSpace(version) == "" {
+		return "an unknown version"
+	}
+	return version
+}
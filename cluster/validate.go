@@ -0,0 +1,212 @@
+package cluster
+
+import (
+	"fmt"
+	"github.com/argon-chat/k3sd/utils"
+	"maps"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+var (
+	// labelNamePattern matches the name part of a Kubernetes label key and a non-empty label value.
+	labelNamePattern = regexp.MustCompile(`^[A-Za-z0-9]([-A-Za-z0-9_.]*[A-Za-z0-9])?$`)
+	// labelPrefixPattern matches the optional DNS subdomain prefix of a Kubernetes label key.
+	labelPrefixPattern = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?(\.[a-z0-9]([-a-z0-9]*[a-z0-9])?)*$`)
+)
+
+// ValidateClusters checks the rules of a loaded config that span several fields or depend on the
+// addons enabled on each cluster, by its addons block or the CLI flags, without connecting to any host:
+//   - every addon in the addons block is registered or declared in extraAddons, declared addons
+//     do not reuse a name, and the dependencies form no cycle,
+//   - each enabled addon, and each addon it depends on, accepts the cluster config,
+//     e.g. domain is set for clusterIssuer and gitea.pg is filled in for gitea,
+//   - the embedded manifests of each enabled addon render, e.g. no template references a missing field,
+//   - k3sVersion and k3sChannel are not both set,
+//   - a cluster with additional servers sets registrationAddress, through which agents join and the kubeconfig points,
+//   - a datastore endpoint is a PostgreSQL, MySQL or etcd URL, unless it is a secret reference, its TLS files
+//     exist and certFile comes with keyFile,
+//   - the extra k3s options of each server and each worker's agent do not repeat a field of their block,
+//   - labels are space-separated k=v pairs with valid Kubernetes keys and values,
+//   - with --airgap-bundle, the bundle holds k3s at the pinned k3sVersion, its install script and images, and
+//     the charts, manifests and images of each enabled addon; linkerd, which pulls its images itself, cannot be enabled.
+//
+// Unique node names and the schema itself are already checked by LoadClusters; CheckClusters reports
+// its problems and these together.
+//
+// Parameters:
+//   - path: The path of the config the clusters were loaded from, used to locate errors.
+//   - clusters: The clusters returned by LoadClusters.
+//
+// Returns:
+//   - ConfigErrors: Every problem found, or nil if the config is valid.
+func ValidateClusters(path string, clusters []Cluster) ConfigErrors {
+	root := configRoot(path)
+
+	var errs ConfigErrors
+	for _, problem := range airgapProblems() {
+		errs = append(errs, locatedError(path, root, "", "%s", problem))
+	}
+	for ci, cluster := range clusters {
+		base := fmt.Sprintf("%s/%d", clustersPointer(root), ci)
+		seen := map[string]bool{}
+		for ai, extra := range cluster.ExtraAddons {
+			pointer := fmt.Sprintf("%s/extraAddons/%d/name", base, ai)
+			if _, ok := LookupAddon(extra.Name); ok || seen[extra.Name] {
+				errs = append(errs, locatedError(path, root, pointer, "addon %q is already defined", extra.Name))
+			}
+			seen[extra.Name] = true
+		}
+		unknown := false
+		for _, name := range slices.Sorted(maps.Keys(cluster.Addons)) {
+			if _, ok := cluster.lookupAddon(name); !ok {
+				errs = append(errs, locatedError(path, root, base+"/addons/"+name, "unknown addon %q", name))
+				unknown = true
+			}
+		}
+		if !unknown {
+			addons, err := clusterAddons(cluster)
+			if err != nil {
+				errs = append(errs, locatedError(path, root, base+"/addons", "%v", err))
+			}
+			for _, addon := range addons {
+				problems := splitErrors(addon.Validate(cluster))
+				for _, problem := range problems {
+					errs = append(errs, locatedError(path, root, base, "%s addon: %v", addon.Name(), problem))
+				}
+				if renderer, ok := addon.(manifestRenderer); ok && len(problems) == 0 {
+					if _, err := renderer.renderManifests(cluster); err != nil {
+						errs = append(errs, locatedError(path, root, base, "%s addon: %v", addon.Name(), err))
+						continue
+					}
+				}
+				if bundler, ok := addon.(imageBundler); ok && len(problems) == 0 {
+					if err := requireBundleImages(cluster, bundler); err != nil {
+						errs = append(errs, locatedError(path, root, base, "%s addon: %v", addon.Name(), err))
+					}
+				}
+			}
+		}
+
+		if cluster.K3sVersion != "" && cluster.K3sChannel != "" {
+			errs = append(errs, locatedError(path, root, base+"/k3sChannel", "k3sChannel is ignored when k3sVersion is set; remove one of them"))
+		}
+		if airgapped() && cluster.K3sVersion != "" {
+			// A bundle recording no version is already reported by airgapProblems.
+			if version, err := bundledK3sVersion(); err == nil && version != cluster.K3sVersion {
+				errs = append(errs, locatedError(path, root, base+"/k3sVersion", "airgap bundle %s holds k3s %s, not %s; rebuild it with k3sd bundle", utils.AirgapBundle, version, cluster.K3sVersion))
+			}
+		}
+		if cluster.highlyAvailable() && cluster.RegistrationAddress == "" {
+			errs = append(errs, locatedError(path, root, base+"/servers", "registrationAddress is required with servers, so that agents and the kubeconfig reach any of them"))
+		}
+		if datastore := cluster.Datastore; datastore.external() {
+			// An endpoint given as a secret reference is checked by ResolveSecrets once resolved.
+			if problem := endpointProblem(datastore.Endpoint); problem != "" && !isSecretRef(datastore.Endpoint) {
+				errs = append(errs, locatedError(path, root, base+"/datastore/endpoint", "%s", problem))
+			}
+			if (datastore.CertFile == "") != (datastore.KeyFile == "") {
+				errs = append(errs, locatedError(path, root, base+"/datastore", "certFile and keyFile must be set together"))
+			}
+			for _, file := range datastore.files() {
+				if _, err := os.Stat(file.local); err != nil {
+					errs = append(errs, locatedError(path, root, base+"/datastore/"+file.field, "%v", err))
+				}
+			}
+		}
+		if err := extraOptionConflicts(serverOptions(cluster, cluster.Server, cluster.embeddedEtcd()), cluster.Server.Extra); err != nil {
+			errs = append(errs, locatedError(path, root, base+"/server/extra", "%v", err))
+		}
+		for si, server := range cluster.Servers {
+			agent := mergeAgentConfig(cluster.Server.AgentConfig, server.Agent)
+			if err := extraOptionConflicts(agent.options(), agent.Extra); err != nil {
+				errs = append(errs, locatedError(path, root, fmt.Sprintf("%s/servers/%d", base, si), "agent: %v", err))
+			}
+		}
+		for wi, worker := range cluster.Workers {
+			agent := mergeAgentConfig(cluster.Agent, worker.Agent)
+			if err := extraOptionConflicts(agent.options(), agent.Extra); err != nil {
+				errs = append(errs, locatedError(path, root, fmt.Sprintf("%s/workers/%d", base, wi), "agent: %v", err))
+			}
+		}
+		for _, problem := range labelProblems(cluster.Labels) {
+			errs = append(errs, locatedError(path, root, base+"/labels", "%s", problem))
+		}
+		for wi, worker := range cluster.Workers {
+			for _, problem := range labelProblems(worker.Labels) {
+				errs = append(errs, locatedError(path, root, fmt.Sprintf("%s/workers/%d/labels", base, wi), "%s", problem))
+			}
+		}
+		for si, server := range cluster.Servers {
+			for _, problem := range labelProblems(server.Labels) {
+				errs = append(errs, locatedError(path, root, fmt.Sprintf("%s/servers/%d/labels", base, si), "%s", problem))
+			}
+		}
+	}
+	return errs
+}
+
+// splitErrors unwraps an error joined with errors.Join into its parts.
+//
+// Parameters:
+//   - err: The error, possibly nil.
+//
+// Returns:
+//   - []error: The joined errors, the error itself if it is not joined, or nil.
+func splitErrors(err error) []error {
+	if err == nil {
+		return nil
+	}
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		return joined.Unwrap()
+	}
+	return []error{err}
+}
+
+// labelProblems checks that a label string is a list of space-separated k=v pairs, as passed to `kubectl label`.
+//
+// Parameters:
+//   - labels: The label string of a node.
+//
+// Returns:
+//   - []string: A description of every malformed pair, or nil if all are valid.
+func labelProblems(labels string) []string {
+	var problems []string
+	for _, pair := range strings.Fields(labels) {
+		key, value, ok := strings.Cut(pair, "=")
+		if !ok {
+			problems = append(problems, fmt.Sprintf("label %q is not a k=v pair", pair))
+			continue
+		}
+		if err := validLabelKey(key); err != "" {
+			problems = append(problems, fmt.Sprintf("label %q: %s", pair, err))
+		}
+		if value != "" && (len(value) > 63 || !labelNamePattern.MatchString(value)) {
+			problems = append(problems, fmt.Sprintf("label %q: value must be at most 63 alphanumeric characters, '-', '_' or '.', starting and ending with an alphanumeric", pair))
+		}
+	}
+	return problems
+}
+
+// validLabelKey checks a Kubernetes label key of the form [prefix/]name.
+//
+// Parameters:
+//   - key: The label key.
+//
+// Returns:
+//   - string: A description of the problem, or an empty string if the key is valid.
+func validLabelKey(key string) string {
+	name := key
+	if prefix, rest, ok := strings.Cut(key, "/"); ok {
+		if len(prefix) > 253 || !labelPrefixPattern.MatchString(prefix) {
+			return "key prefix must be a lowercase DNS subdomain"
+		}
+		name = rest
+	}
+	if len(name) > 63 || !labelNamePattern.MatchString(name) {
+		return "key name must be 1-63 alphanumeric characters, '-', '_' or '.', starting and ending with an alphanumeric"
+	}
+	return ""
+}
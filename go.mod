@@ -2,6 +2,12 @@ module github.com/argon-chat/k3sd
 
 go 1.24
 
-require golang.org/x/crypto v0.38.0
+require (
+	filippo.io/age v1.2.1
+	github.com/santhosh-tekuri/jsonschema/v6 v6.0.2
+	golang.org/x/crypto v0.38.0
+	golang.org/x/text v0.25.0
+	gopkg.in/yaml.v3 v3.0.1
+)
 
 require golang.org/x/sys v0.33.0 // indirect
@@ -3,13 +3,32 @@ package utils
 import (
 	"flag"
 	"fmt"
+	"os"
+	"strings"
 )
 
 var (
-	Flags       map[string]bool
-	ConfigPath  string
-	Uninstall   bool
-	VersionFlag bool
+	Flags         map[string]bool
+	ConfigPath    string
+	Uninstall     bool
+	VersionFlag   bool
+	HostKeyPolicy string
+	Parallel      int
+	ForceSteps    []string
+	Command       string
+	Output        string
+	RenderDir     string
+	AirgapBundle  string
+	K3sVersion    string
+	Arch          string
+	UpgradeTo     string
+)
+
+// Subcommands of k3sd; without one, k3sd provisions or uninstalls the clusters.
+const (
+	CommandValidate = "validate" // Lints the config without touching any host.
+	CommandBundle   = "bundle"   // Downloads an air-gap bundle for the config.
+	CommandUpgrade  = "upgrade"  // Rolls the clusters over to another k3s release.
 )
 
 func ParseFlags() {
@@ -23,12 +42,39 @@ func ParseFlags() {
 	uninstallFlag := flag.Bool("uninstall", false, "Uninstall the cluster")
 	linkerd := flag.Bool("linkerd", false, "Install linkerd")
 	linkerdMc := flag.Bool("linkerd-mc", false, "Install linkerd multicluster(will install linkerd first)")
+	parallel := flag.Int("parallel", 1, "Number of clusters, and of workers per cluster, to provision concurrently")
+	forceStep := flag.String("force-step", "", "Comma-separated step names to re-run even if they already completed, e.g. prometheus,linkerd")
 	versionFlag := flag.Bool("version", false, "Print the version and exit")
+	renderDir := flag.String("render-dir", "", "Write the rendered addon manifests of each cluster to this directory for review")
+	airgapBundle := flag.String("airgap-bundle", "", "Install from this air-gap bundle directory instead of the internet; written by the bundle command")
+	k3sVersion := flag.String("k3s-version", "", "k3s release packaged by the bundle command, e.g. v1.32.3+k3s1; by default the one the config pins, or the stable channel's")
+	arch := flag.String("arch", "amd64", "Architecture of the nodes packaged by the bundle command: amd64, arm64 or arm")
+	upgradeTo := flag.String("to", "", "k3s release the upgrade command upgrades the clusters to, e.g. v1.32.3+k3s1")
+	output := flag.String("output", "text", "Output format of the validate command: text or json")
+	hostKeyPolicy := flag.String("host-key-policy", "tofu", "Host key verification: strict (known_hosts only), tofu (known_hosts, then pin in the state file) or insecure")
 
-	flag.Parse()
+	args := os.Args[1:]
+	if len(args) > 0 && (args[0] == CommandValidate || args[0] == CommandBundle || args[0] == CommandUpgrade) {
+		Command = args[0]
+		args = args[1:]
+	}
+	_ = flag.CommandLine.Parse(args)
 
 	VersionFlag = *versionFlag
 	Uninstall = *uninstallFlag
+	HostKeyPolicy = *hostKeyPolicy
+	Parallel = *parallel
+	Output = *output
+	RenderDir = *renderDir
+	AirgapBundle = *airgapBundle
+	K3sVersion = *k3sVersion
+	Arch = *arch
+	UpgradeTo = *upgradeTo
+	for _, name := range strings.Split(*forceStep, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			ForceSteps = append(ForceSteps, name)
+		}
+	}
 	Flags = map[string]bool{
 		"cert-manager":   *certManager,
 		"traefik-values": *traefik,
@@ -13,6 +13,7 @@ type Logger struct {
 	File   chan FileWithInfo // Channel for file log messages.
 	Cmd    chan string       // Channel for command log messages.
 	Id     string            // Identifier for the logger instance.
+	Prefix string            // Prefix prepended to messages, identifying the host they come from.
 }
 
 // FileWithInfo represents a file log message with its file name and content.
@@ -38,13 +39,39 @@ func NewLogger(id string) *Logger {
 	}
 }
 
+// WithPrefix returns a Logger that shares this logger's channels and identifier
+// but prepends a host prefix to every message, keeping interleaved output readable.
+//
+// Parameters:
+//   - prefix: A string identifying the host, appended to any existing prefix.
+//
+// Returns:
+//   - A pointer to the prefixed Logger instance.
+func (l *Logger) WithPrefix(prefix string) *Logger {
+	child := *l
+	if l.Prefix != "" {
+		prefix = l.Prefix + "/" + prefix
+	}
+	child.Prefix = prefix
+	return &child
+}
+
+// format formats a message, masks registered secrets, and prepends the logger's prefix, if any.
+func (l *Logger) format(format string, args ...interface{}) string {
+	message := maskSecrets(fmt.Sprintf(format, args...))
+	if l.Prefix == "" {
+		return message
+	}
+	return fmt.Sprintf("[%s] %s", l.Prefix, message)
+}
+
 // Log formats a log message and sends it to the Stdout channel.
 //
 // Parameters:
 //   - format: A string containing the format of the log message (similar to fmt.Sprintf).
 //   - args: A variadic list of arguments to be formatted into the log message.
 func (l *Logger) Log(format string, args ...interface{}) {
-	l.Stdout <- fmt.Sprintf(format, args...)
+	l.Stdout <- l.format(format, args...)
 }
 
 // LogErr formats an error log message and sends it to the Stderr channel.
@@ -53,7 +80,7 @@ func (l *Logger) Log(format string, args ...interface{}) {
 //   - format: A string containing the format of the error log message (similar to fmt.Sprintf).
 //   - args: A variadic list of arguments to be formatted into the error log message.
 func (l *Logger) LogErr(format string, args ...interface{}) {
-	l.Stderr <- fmt.Sprintf(format, args...)
+	l.Stderr <- l.format(format, args...)
 }
 
 // LogFile formats a log message and sends it to the File channel.
@@ -62,7 +89,7 @@ func (l *Logger) LogErr(format string, args ...interface{}) {
 //   - filePath: A string representing the path of the file being logged.
 //   - content: A string containing the content of the file being logged.
 func (l *Logger) LogFile(filePath, content string) {
-	l.File <- FileWithInfo{FileName: filePath, Content: content}
+	l.File <- FileWithInfo{FileName: filePath, Content: maskSecrets(content)}
 }
 
 // LogCmd formats a command log message and sends it to the Cmd channel.
@@ -71,7 +98,7 @@ func (l *Logger) LogFile(filePath, content string) {
 //   - format: A string containing the format of the command log message (similar to fmt.Sprintf).
 //   - args: A variadic list of arguments to be formatted into the command log message.
 func (l *Logger) LogCmd(format string, args ...interface{}) {
-	l.Cmd <- fmt.Sprintf(format, args...)
+	l.Cmd <- l.format(format, args...)
 }
 
 // LogWorker continuously processes log messages from the Stdout channel
@@ -0,0 +1,44 @@
+package utils
+
+import (
+	"strings"
+	"sync"
+)
+
+// minMaskedSecretLength is the length below which secrets are not masked, since replacing a value as short
+// as "root" everywhere in the logs would mask unrelated words rather than hide the secret.
+const minMaskedSecretLength = 6
+
+var (
+	secretsMu sync.RWMutex
+	secrets   []string
+)
+
+// MaskSecret registers a secret that every Logger replaces with "******" in its messages.
+//
+// Parameters:
+//   - secret: The secret to mask; secrets shorter than minMaskedSecretLength are ignored.
+func MaskSecret(secret string) {
+	if len(secret) < minMaskedSecretLength {
+		return
+	}
+	secretsMu.Lock()
+	defer secretsMu.Unlock()
+	secrets = append(secrets, secret)
+}
+
+// maskSecrets replaces every registered secret in a message with "******".
+//
+// Parameters:
+//   - message: The message to mask.
+//
+// Returns:
+//   - string: The masked message.
+func maskSecrets(message string) string {
+	secretsMu.RLock()
+	defer secretsMu.RUnlock()
+	for _, secret := range secrets {
+		message = strings.ReplaceAll(message, secret, "******")
+	}
+	return message
+}
@@ -0,0 +1,11 @@
+// Package yamls embeds the manifests and Helm values that k3sd applies to clusters,
+// so that what gets applied always matches the running binary.
+package yamls
+
+import "embed"
+
+// FS holds every manifest and values file of this directory. Files ending in .tmpl are Go
+// templates rendered against the cluster they are applied to.
+//
+//go:embed *.yaml *.tmpl
+var FS embed.FS